@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ----- Amount ----- //
+// Amount is a fixed-point decimal kept as a whole number of its smallest unit.
+// The scale (number of decimals) is not stored in the amount, it belongs to the stock:
+// prices use Stock.PriceScale and counts of units use Stock.UnitScale
+type Amount int64
+
+// Rounding applied when an amount loses decimals
+type Rounding int
+
+const (
+	round_down    Rounding = iota // toward zero
+	round_half_up                 // to the nearest, halves away from zero
+)
+
+// Largest number of decimals a stock may use
+const max_scale = 8
+
+// Check scale - a scale must be between 0 and max_scale
+func check_scale(scale int) error {
+	if scale < 0 || scale > max_scale {
+		return errors.New("Scale must be between 0 and " + strconv.Itoa(max_scale))
+	}
+	return nil
+}
+
+// Parse scale - read a scale argument
+func parse_scale(value string) (int, error) {
+	scale, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("Scale must be a numeric string - " + value)
+	}
+	return scale, check_scale(scale)
+}
+
+// Pow10 - 10^n as an amount, n <= 18
+func pow10(n int) Amount {
+	p := Amount(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// Parse amount - read a non-negative decimal string with at most scale decimals, e.g. "12345.67" at scale 2.
+// Signs, exponents, separators and extra decimals are rejected rather than rounded
+func parse_amount(value string, scale int) (Amount, error) {
+	err := check_scale(scale)
+	if err != nil {
+		return 0, err
+	}
+
+	whole := value
+	fraction := ""
+	if dot := strings.IndexByte(value, '.'); dot >= 0 {
+		whole = value[:dot]
+		fraction = value[dot+1:]
+		if len(fraction) == 0 {
+			return 0, errors.New("Invalid amount - " + value)
+		}
+	}
+	if len(whole) == 0 || !is_digits(whole) || !is_digits(fraction) {
+		return 0, errors.New("Invalid amount - " + value)
+	}
+	if len(fraction) > scale {
+		return 0, errors.New("Amount " + value + " has more than " + strconv.Itoa(scale) + " decimals")
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	units, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, errors.New("Amount out of range - " + value)
+	}
+	return Amount(units), nil
+}
+
+// Is digits - whether a string only holds the digits 0-9
+func is_digits(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Format amount - write an amount with exactly scale decimals, e.g. 1234567 at scale 2 is "12345.67"
+func format_amount(amount Amount, scale int) string {
+	sign := ""
+	digits := strconv.FormatUint(uint64(amount), 10)
+	if amount < 0 {
+		sign = "-"
+		digits = strconv.FormatUint(uint64(-(amount+1))+1, 10)
+	}
+	if scale <= 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// Add amount - a + b, failing on overflow
+func add_amount(a Amount, b Amount) (Amount, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, errors.New("Amount overflow")
+	}
+	return a + b, nil
+}
+
+// Sub amount - a - b, failing on overflow
+func sub_amount(a Amount, b Amount) (Amount, error) {
+	if (b < 0 && a > math.MaxInt64+b) || (b > 0 && a < math.MinInt64+b) {
+		return 0, errors.New("Amount overflow")
+	}
+	return a - b, nil
+}
+
+// Mul amount - a * b, failing on overflow. The scale of the product is the sum of the scales
+func mul_amount(a Amount, b Amount) (Amount, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	c := a * b
+	if c/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, errors.New("Amount overflow")
+	}
+	return c, nil
+}
+
+// Rescale amount - convert an amount from one scale to another, rounding the extra decimals
+func rescale_amount(amount Amount, from int, to int, rounding Rounding) (Amount, error) {
+	if to >= from {
+		return mul_amount(amount, pow10(to-from))
+	}
+	divisor := pow10(from - to)
+	quotient := amount / divisor
+	remainder := amount % divisor
+	if rounding == round_half_up {
+		if remainder >= divisor-remainder && remainder > 0 {
+			quotient++
+		} else if -remainder >= divisor+remainder && remainder < 0 {
+			quotient--
+		}
+	}
+	return quotient, nil
+}
+
+// Compare amount - compare two amounts of different scales, -1, 0 or 1
+func compare_amount(a Amount, a_scale int, b Amount, b_scale int) int {
+	x := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(pow10(b_scale))))
+	y := new(big.Int).Mul(big.NewInt(int64(b)), big.NewInt(int64(pow10(a_scale))))
+	return x.Cmp(y)
+}
+
+// Mul div amount - a * b / c without overflowing on the intermediate product, dropping the remainder
+func mul_div_amount(a Amount, b Amount, c Amount) (Amount, error) {
+	if c == 0 {
+		return 0, errors.New("Division by zero")
+	}
+	product := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(b)))
+	quotient := product.Quo(product, big.NewInt(int64(c)))
+	if !quotient.IsInt64() {
+		return 0, errors.New("Amount overflow")
+	}
+	return Amount(quotient.Int64()), nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- AuditIssue ----- //
+type AuditIssue struct {
+	Key    string `json:"key"`
+	Type   string `json:"type"` // undecodable, unknown_doc_type, wrong_namespace, shadowed, id_mismatch, negative_balance, duplicate_position, unknown_stock, unknown_user, missing_index, duplicate_code, invalid_status, conservation
+	Detail string `json:"detail"`
+}
+
+// ----- StockBalance ----- //
+type StockBalance struct {
+	StockId string `json:"stock_id"`
+	Issued  Amount `json:"issued"` // Stock.Count cộng các thay đổi phát hành
+	Held    Amount `json:"held"`   // tổng số lượng trong các ví
+	Holders int    `json:"holders"`
+}
+
+// ----- AuditReport ----- //
+type AuditReport struct {
+	Scanned  int            `json:"scanned"`
+	Stocks   int            `json:"stocks"`
+	Users    int            `json:"users"`
+	Trades   int            `json:"trades"`
+	Balances []StockBalance `json:"balances"`
+	Issues   []AuditIssue   `json:"issues"`
+	Ok       bool           `json:"ok"`
+}
+
+// Audit state - check every stored document: it must decode, carry a known docType and the id of its key
+// and sit in the namespace of its docType, each stock must have a known status and hold its code in the code index, holdings must
+// hold each stock once with a positive count and be indexed, trades must name existing stocks and users,
+// and the counts held in wallets must add up to the issued count of each stock
+func audit_state(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var report AuditReport
+	log_debug(stub, "starting")
+
+	issue := func(key string, kind string, detail string) {
+		report.Issues = append(report.Issues, AuditIssue{Key: key, Type: kind, Detail: detail})
+	}
+
+	// kept in id order so the report is the same on every peer
+	stocks := make(map[string]Stock)
+	users := make(map[string]User)
+	var stock_ids, user_ids []string
+	var trades []Trade
+
+	check := func(id string, object_type string, value []byte) {
+		report.Scanned++
+		var header struct {
+			ObjectType string `json:"docType"`
+			Id         string `json:"id"`
+		}
+		err := json.Unmarshal(value, &header)
+		if err != nil {
+			issue(id, "undecodable", err.Error())
+			return
+		}
+		if header.Id != id {
+			issue(id, "id_mismatch", "document id is '"+header.Id+"'")
+		}
+		if len(header.ObjectType) > 0 && header.ObjectType != object_type {
+			issue(id, "wrong_namespace", "docType is '"+header.ObjectType+"' in the "+object_type+" namespace")
+			return
+		}
+
+		switch object_type {
+		case stock_namespace:
+			stock, err := decode_stock(value)
+			if err != nil {
+				issue(id, "undecodable", err.Error())
+				return
+			}
+			if !contains(stock_statuses, stock.Status) {
+				issue(id, "invalid_status", "status '"+stock.Status+"'")
+			}
+			if stock.Count < 0 || stock.Price < 0 {
+				issue(id, "negative_balance", "count "+format_amount(stock.Count, stock.UnitScale)+", price "+format_amount(stock.Price, stock.PriceScale))
+			}
+			stocks[stock.Id] = stock
+			stock_ids = append(stock_ids, stock.Id)
+		case user_namespace:
+			user, err := decode_user(value)
+			if err != nil {
+				issue(id, "undecodable", err.Error())
+				return
+			}
+			users[user.Id] = user
+			user_ids = append(user_ids, user.Id)
+		case trade_namespace:
+			trade, err := decode_trade(value)
+			if err != nil {
+				issue(id, "undecodable", err.Error())
+				return
+			}
+			trades = append(trades, trade)
+		}
+	}
+
+	namespaces := []string{stock_namespace, user_namespace, trade_namespace}
+	for _, object_type := range namespaces {
+		err := scan_entities(stub, object_type, func(id string, value []byte) error {
+			check(id, object_type, value)
+			return nil
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	sort.Strings(stock_ids)
+	sort.Strings(user_ids)
+
+	// simple keys left
+	resultsIterator, err := stub.GetStateByRange(min_key, max_key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		key := aKeyValue.Key
+		if is_composite_key(key) {
+			continue
+		}
+		// entities not migrated yet were checked above, unless the namespace holds a newer copy
+		object_type := legacy_type(key, aKeyValue.Value)
+		if contains(namespaces, object_type) {
+			entityKey, err := entity_key(stub, object_type, key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			entityAsBytes, err := stub.GetState(entityKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if entityAsBytes != nil {
+				report.Scanned++
+				issue(key, "shadowed", "stored both under its id and in the "+object_type+" namespace")
+			}
+			continue
+		}
+		report.Scanned++
+
+		var header struct {
+			ObjectType string `json:"docType"`
+		}
+		err = json.Unmarshal(aKeyValue.Value, &header)
+		if err != nil {
+			issue(key, "undecodable", err.Error())
+			continue
+		}
+		issue(key, "unknown_doc_type", "docType is '"+header.ObjectType+"'")
+	}
+	report.Stocks = len(stocks)
+	report.Users = len(users)
+	report.Trades = len(trades)
+
+	// ---- holdings --- //
+	held := make(map[string]Amount)
+	holders := make(map[string]int)
+	hold := func(key string, asset Asset) {
+		stock, found := stocks[asset.Id]
+		if !found {
+			issue(key, "unknown_stock", "holds unknown stock "+asset.Id)
+			return
+		}
+		if asset.Count <= 0 {
+			issue(key, "negative_balance", "holds "+format_amount(asset.Count, stock.UnitScale)+" of "+asset.Id)
+		}
+		total, err := add_amount(held[asset.Id], asset.Count)
+		if err != nil {
+			issue(key, "conservation", "total held of "+asset.Id+" overflows")
+		}
+		held[asset.Id] = total
+		holders[asset.Id]++
+	}
+
+	// wallets embedded in users not migrated yet
+	for _, user_id := range user_ids {
+		user := users[user_id]
+		seen := make(map[string]bool)
+		for _, asset := range user.Wallet {
+			if seen[asset.Id] {
+				issue(user.Id, "duplicate_position", "stock "+asset.Id+" is held more than once")
+			}
+			seen[asset.Id] = true
+			hold(user.Id, asset)
+		}
+	}
+
+	// holding keys plus the deltas not folded yet, in key order
+	positions := make(map[string]Asset)
+	var position_keys []string
+	position := func(user_id string, stock_id string, count Amount) {
+		key := user_id + "/" + stock_id
+		asset, found := positions[key]
+		if !found {
+			position_keys = append(position_keys, key)
+			asset.Id = stock_id
+		}
+		total, err := add_amount(asset.Count, count)
+		if err != nil {
+			issue(key, "conservation", "balance overflows")
+		}
+		asset.Count = total
+		positions[key] = asset
+
+		user, found := users[user_id]
+		if !found {
+			issue(key, "unknown_user", "balance of unknown user "+user_id)
+		} else if len(user.Wallet) > 0 {
+			issue(key, "duplicate_position", "held both in the wallet of the user and under a holding key")
+		}
+	}
+
+	holdingIterator, err := stub.GetStateByPartialCompositeKey(holding_by_user, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer holdingIterator.Close()
+
+	for holdingIterator.HasNext() {
+		aKeyValue, err := holdingIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		user_id, stock_id := attributes[0], attributes[1]
+
+		var asset Asset
+		err = json.Unmarshal(aKeyValue.Value, &asset)
+		if err != nil {
+			issue(user_id+"/"+stock_id, "undecodable", err.Error())
+			continue
+		}
+		if asset.Id != stock_id {
+			issue(user_id+"/"+stock_id, "id_mismatch", "holding is of stock '"+asset.Id+"'")
+		}
+		position(user_id, stock_id, asset.Count)
+	}
+
+	deltaIterator, err := stub.GetStateByPartialCompositeKey(delta_by_user, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer deltaIterator.Close()
+
+	for deltaIterator.HasNext() {
+		aKeyValue, err := deltaIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		user_id, stock_id := attributes[0], attributes[1]
+
+		var delta Delta
+		err = json.Unmarshal(aKeyValue.Value, &delta)
+		if err != nil {
+			issue(user_id+"/"+stock_id, "undecodable", err.Error())
+			continue
+		}
+		position(user_id, stock_id, delta.Count)
+	}
+	sort.Strings(position_keys)
+
+	for _, key := range position_keys {
+		asset := positions[key]
+		if asset.Count == 0 {
+			continue
+		}
+		user_id := key[:len(key)-len(asset.Id)-1]
+		holderKey, err := stub.CreateCompositeKey(holder_by_stock, []string{asset.Id, user_id})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		indexAsBytes, err := stub.GetState(holderKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if indexAsBytes == nil {
+			issue(key, "missing_index", "no holder index entry")
+		}
+		hold(key, asset)
+	}
+
+	// ---- codes --- //
+	for _, stock_id := range stock_ids {
+		stock := stocks[stock_id]
+		code_id, err := get_stock_id_by_code(stub, stock.Code)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(code_id) == 0 {
+			issue(stock.Id, "missing_index", "code "+stock.Code+" is not indexed")
+		} else if code_id != stock.Id {
+			issue(stock.Id, "duplicate_code", "code "+stock.Code+" is held by "+code_id)
+		}
+	}
+
+	// ---- trades --- //
+	for _, trade := range trades {
+		if _, found := stocks[trade.Stock.Id]; !found {
+			issue(trade.Id, "unknown_stock", "trade of unknown stock "+trade.Stock.Id)
+		}
+		if _, found := users[trade.Seller.Id]; !found {
+			issue(trade.Id, "unknown_user", "trade with unknown seller "+trade.Seller.Id)
+		}
+		if _, found := users[trade.Buyer.Id]; !found {
+			issue(trade.Id, "unknown_user", "trade with unknown buyer "+trade.Buyer.Id)
+		}
+		if trade.Stock.Count <= 0 {
+			issue(trade.Id, "negative_balance", "trade count is not positive")
+		}
+	}
+
+	// ---- conservation --- //
+	for _, stock_id := range stock_ids {
+		stock := stocks[stock_id]
+		err = with_issued(stub, &stock)
+		if err != nil {
+			issue(stock.Id, "undecodable", err.Error())
+		}
+		balance := StockBalance{StockId: stock.Id, Issued: stock.Count, Held: held[stock.Id], Holders: holders[stock.Id]}
+		if balance.Held != balance.Issued {
+			issue(stock.Id, "conservation", "issued "+format_amount(balance.Issued, stock.UnitScale)+" but holders hold "+format_amount(balance.Held, stock.UnitScale))
+		}
+		report.Balances = append(report.Balances, balance)
+	}
+
+	report.Ok = len(report.Issues) == 0
+	log_info(stub, "audit done", "issues", len(report.Issues), "scanned", report.Scanned)
+
+	//change to array of bytes
+	reportAsBytes, _ := json.Marshal(report)
+	return shim.Success(reportAsBytes)
+}
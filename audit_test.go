@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Audit - run audit_state and return its report
+func audit(t *testing.T, sim *Simulator, at string) AuditReport {
+	t.Helper()
+	var report AuditReport
+	err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "audit_state", at)), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestAuditStateAcceptsTradesAndFundFlows(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:03Z", "t1", "s1", "30", "u1", "u2", "2024-01-01", "100")
+	band_call(t, sim, role_issuer, true, "subscribe", "2024-01-01T00:00:04Z", "s1", "u2", "1000")
+	band_call(t, sim, role_issuer, true, "redeem", "2024-01-01T00:00:05Z", "s1", "u1", "all")
+	band_call(t, sim, role_admin, true, "compact_balance", "2024-01-01T00:00:06Z", "u2")
+
+	report := audit(t, sim, "2024-01-01T00:00:07Z")
+	if !report.Ok || len(report.Balances) != 1 {
+		t.Fatalf("unexpected report - %+v", report)
+	}
+	if balance := report.Balances[0]; balance.Issued != 40 || balance.Held != 40 || balance.Holders != 1 {
+		t.Fatalf("unexpected balance - %+v", balance)
+	}
+}
+
+func TestAuditStateReportsCorruptedState(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:03Z", "t1", "s1", "30", "u1", "u2", "2024-01-01", "100")
+
+	holderKey, _ := sim.stub.CreateCompositeKey(holder_by_stock, []string{"s1", "u2"})
+	sim.state.del(holderKey)
+	deltaKey, _ := sim.stub.CreateCompositeKey(delta_by_user, []string{"u1", "s1", "forged", "buy"})
+	sim.state.put(deltaKey, []byte(`{"docType":"delta","user_id":"u1","stock_id":"s1","count":5,"cause":"buy"}`))
+	userKey, _ := entity_key(sim.stub, user_namespace, "u3")
+	sim.state.put(userKey, []byte(`{"docType":"user","version":1,`))
+
+	report := audit(t, sim, "2024-01-01T00:00:04Z")
+	var kinds []string
+	for _, issue := range report.Issues {
+		kinds = append(kinds, issue.Type)
+	}
+	sort.Strings(kinds)
+	if report.Ok || strings.Join(kinds, ",") != "conservation,missing_index,undecodable" {
+		t.Fatalf("unexpected issues - %+v", report.Issues)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ========================================================
+// Price band - the prices of a stock, set by update_price or agreed in a trade, must stay within
+// band_bps of a daily reference price. The reference is the price of the stock when the first price
+// of a day is checked, i.e. the last price of the previous day. A price moving halt_bps or more away
+// from the reference is accepted but halts the stock until an admin resumes it
+// ========================================================
+
+// Basis points in one
+const bps = 10000
+
+// Band and circuit breaker of a new stock, and of a stock written before the price band, until an admin
+// changes them with set_price_band
+const (
+	default_band_bps = 700
+	default_halt_bps = 500
+)
+
+// Tx day - the UTC day of the transaction timestamp
+func tx_day(stub shim.ChaincodeStubInterface) (string, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", err
+	}
+	when, err := ptypes.Timestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+	return when.UTC().Format("2006-01-02"), nil
+}
+
+// Roll reference - on the first price of a new day the reference becomes the current price
+func roll_reference(stub shim.ChaincodeStubInterface, stock *Stock) error {
+	day, err := tx_day(stub)
+	if err != nil {
+		return err
+	}
+	if stock.RefDay != day {
+		if stock.Price > 0 {
+			stock.RefPrice = stock.Price
+		}
+		stock.RefDay = day
+	}
+	return nil
+}
+
+// Check price - reject a price that is not positive or lies outside the band of the day, and tell whether
+// it hits the circuit breaker. The reference of the stock is rolled over first, the caller stores it
+func check_price(stub shim.ChaincodeStubInterface, stock *Stock, price Amount) (bool, error) {
+	if price <= 0 {
+		return false, errors.New("Price must be positive")
+	}
+	err := roll_reference(stub, stock)
+	if err != nil {
+		return false, err
+	}
+	if stock.RefPrice <= 0 {
+		return false, nil
+	}
+
+	move := price - stock.RefPrice
+	if move < 0 {
+		move = -move
+	}
+	if stock.BandBps > 0 {
+		band, err := mul_div_amount(stock.RefPrice, Amount(stock.BandBps), bps)
+		if err != nil {
+			return false, err
+		}
+		if move > band {
+			return false, errors.New("Price " + format_amount(price, stock.PriceScale) + " is outside the band " +
+				format_amount(stock.RefPrice-band, stock.PriceScale) + " - " + format_amount(stock.RefPrice+band, stock.PriceScale) +
+				" of stock " + stock.Id)
+		}
+	}
+	if stock.HaltBps > 0 {
+		threshold, err := mul_div_amount(stock.RefPrice, Amount(stock.HaltBps), bps)
+		if err != nil {
+			return false, err
+		}
+		return move >= threshold, nil
+	}
+	return false, nil
+}
+
+// Parse bps - a number of basis points between 0 and 10000
+func parse_bps(value string) (int, error) {
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 || result > bps {
+		return 0, errors.New("Basis points must be an integer between 0 and 10000 - " + value)
+	}
+	return result, nil
+}
+
+// Set price band - configure the band and the circuit breaker of a stock, in basis points of the reference price
+// (0 disables them), and optionally set the reference price of the day
+func set_price_band(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	log_debug(stub, "starting")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 to 4")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stock_id := args[0]
+	band_bps, err := parse_bps(args[1])
+	if err != nil {
+		return shim.Error("2nd argument - " + err.Error())
+	}
+	halt_bps, err := parse_bps(args[2])
+	if err != nil {
+		return shim.Error("3rd argument - " + err.Error())
+	}
+	if band_bps > 0 && halt_bps > band_bps {
+		return shim.Error("The circuit breaker threshold must lie within the band")
+	}
+
+	uow := new_unit_of_work(stub)
+	stock, err := get_stock(uow, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+
+	if len(args) == 4 {
+		ref_price, err := parse_amount(args[3], stock.PriceScale)
+		if err != nil || ref_price <= 0 {
+			return shim.Error("4th argument must be a positive numeric string")
+		}
+		stock.RefDay, err = tx_day(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		stock.RefPrice = ref_price
+	}
+	stock.BandBps = band_bps
+	stock.HaltBps = halt_bps
+
+	stockAsBytes, _ := json.Marshal(stock) //convert to array of bytes
+	err = put_entity(uow, stock_namespace, stock.Id, stockAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = uow.commit()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "price band set", "stock_id", stock.Id, "band_bps", band_bps, "halt_bps", halt_bps,
+		"ref_price", format_amount(stock.RefPrice, stock.PriceScale))
+	return shim.Success(nil)
+}
+
+// Resume stock - reopen a stock halted by the circuit breaker, the band is centered on its current price
+func resume_stock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	log_debug(stub, "starting")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	stock_id := args[0]
+	uow := new_unit_of_work(stub)
+	stock, err := get_stock(uow, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+	if stock.Status != stock_halted {
+		return shim.Error("This stock is not halted - " + stock_id)
+	}
+
+	stock.Status = stock_active
+	stock.RefDay, err = tx_day(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if stock.Price > 0 {
+		stock.RefPrice = stock.Price
+	}
+
+	stockAsBytes, _ := json.Marshal(stock) //convert to array of bytes
+	err = put_entity(uow, stock_namespace, stock.Id, stockAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = uow.commit()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "stock resumed", "stock_id", stock.Id, "ref_price", format_amount(stock.RefPrice, stock.PriceScale))
+	return shim.Success(nil)
+}
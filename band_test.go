@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Band sim - a simulator with users u1 and u2, and stock s1 held by u1 at price 100
+// with a 7% band and a 5% circuit breaker. Chaincode logs are discarded
+func band_sim(t *testing.T) *Simulator {
+	log_output = ioutil.Discard
+	t.Cleanup(func() { log_output = nil })
+
+	sim := new_simulator()
+	band_call(t, sim, role_admin, true, "init_user", "2024-01-01T00:00:00Z", "u1", "A")
+	band_call(t, sim, role_admin, true, "init_user", "2024-01-01T00:00:00Z", "u2", "B")
+	band_call(t, sim, role_admin, true, "init_stock", "2024-01-01T00:00:01Z", "s1", "ABC", "1000", "100", "u1")
+	band_call(t, sim, role_admin, true, "set_price_band", "2024-01-01T00:00:02Z", "s1", "700", "500")
+	return sim
+}
+
+// Band call - run a call as a role acting for u1, the creator of s1, and check whether it succeeds,
+// returns the message or the payload
+func band_call(t *testing.T, sim *Simulator, role string, succeed bool, function string, at string, args ...string) string {
+	t.Helper()
+	result := sim.run(ScriptCall{Function: function, Args: args, Timestamp: at, User: "u1"}, role, "Org1MSP")
+	if (result.Status == 200) != succeed {
+		t.Fatalf("%s %v: status %d - %s", function, args, result.Status, result.Message)
+	}
+	return result.Message + string(result.Payload)
+}
+
+// Band stock - the stored stock s1
+func band_stock(t *testing.T, sim *Simulator, at string) Stock {
+	t.Helper()
+	var stock Stock
+	err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "read_stock", at, "s1")), &stock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stock
+}
+
+func TestInitStockRejectsNonPositivePrice(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, false, "init_stock", "2024-01-01T00:00:03Z", "s2", "DEF", "1000", "0", "u1")
+	band_call(t, sim, role_admin, false, "bulk_init_stocks", "2024-01-01T00:00:03Z",
+		`[{"id":"s2","code":"DEF","count":1000,"price":0,"user_id":"u1"}]`)
+	band_call(t, sim, role_issuer, false, "update_price", "2024-01-01T00:00:03Z", "s1", "0")
+}
+
+func TestPriceBandRejectsOutOfBandPrices(t *testing.T) {
+	sim := band_sim(t)
+	message := band_call(t, sim, role_issuer, false, "update_price", "2024-01-01T00:00:03Z", "s1", "108")
+	if !strings.Contains(message, "outside the band 93 - 107") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+	band_call(t, sim, role_admin, false, "init_transaction", "2024-01-01T00:00:04Z", "t1", "s1", "5", "u1", "u2", "2024-01-01", "92")
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:04Z", "t1", "s1", "5", "u1", "u2", "2024-01-01", "103")
+	band_call(t, sim, role_issuer, true, "update_price", "2024-01-01T00:00:05Z", "s1", "104")
+
+	stock := band_stock(t, sim, "2024-01-01T00:00:06Z")
+	if stock.Status != stock_active || stock.Price != 104 || stock.RefPrice != 100 {
+		t.Fatalf("unexpected stock - %+v", stock)
+	}
+
+	// the reference of the next day is the last price
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-02T00:00:01Z", "t2", "s1", "1", "u1", "u2", "2024-01-02", "108")
+	stock = band_stock(t, sim, "2024-01-02T00:00:02Z")
+	if stock.RefPrice != 104 || stock.RefDay != "2024-01-02" {
+		t.Fatalf("reference not rolled over - %+v", stock)
+	}
+}
+
+func TestCircuitBreakerHaltsUntilResumed(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:03Z", "t1", "s1", "5", "u1", "u2", "2024-01-01", "95")
+	if stock := band_stock(t, sim, "2024-01-01T00:00:04Z"); stock.Status != stock_halted {
+		t.Fatalf("stock not halted - %+v", stock)
+	}
+
+	band_call(t, sim, role_admin, false, "init_transaction", "2024-01-01T00:00:05Z", "t2", "s1", "1", "u1", "u2", "2024-01-01", "100")
+	band_call(t, sim, role_issuer, false, "update_price", "2024-01-01T00:00:05Z", "s1", "100")
+	band_call(t, sim, role_issuer, false, "set_stock_status", "2024-01-01T00:00:05Z", "s1", stock_suspended)
+	band_call(t, sim, role_issuer, false, "set_stock_status", "2024-01-01T00:00:05Z", "s1", stock_active)
+	band_call(t, sim, role_issuer, false, "resume_stock", "2024-01-01T00:00:05Z", "s1")
+
+	band_call(t, sim, role_admin, true, "resume_stock", "2024-01-01T00:00:06Z", "s1")
+	band_call(t, sim, role_admin, false, "resume_stock", "2024-01-01T00:00:06Z", "s1")
+	stock := band_stock(t, sim, "2024-01-01T00:00:07Z")
+	if stock.Status != stock_active || stock.RefPrice != stock.Price {
+		t.Fatalf("stock not reopened around its price - %+v", stock)
+	}
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:08Z", "t2", "s1", "1", "u1", "u2", "2024-01-01", "100")
+}
+
+func TestUpdatePriceHaltsAtThreshold(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_issuer, true, "update_price", "2024-01-01T00:00:03Z", "s1", "105")
+	stock := band_stock(t, sim, "2024-01-01T00:00:04Z")
+	if stock.Status != stock_halted || stock.Price != 105 {
+		t.Fatalf("stock not halted - %+v", stock)
+	}
+	band_call(t, sim, role_admin, true, "resume_stock", "2024-01-01T00:00:05Z", "s1")
+	if stock := band_stock(t, sim, "2024-01-01T00:00:06Z"); stock.RefPrice != 105 {
+		t.Fatalf("band not centered on the price - %+v", stock)
+	}
+}
+
+func TestStockStatusReservedToCreator(t *testing.T) {
+	sim := band_sim(t)
+	call := ScriptCall{Function: "set_stock_status", Args: []string{"s1", stock_suspended}, Timestamp: "2024-01-01T00:00:03Z", User: "u2"}
+	if result := sim.run(call, role_issuer, "Org1MSP"); result.Status == 200 {
+		t.Fatal("another issuer suspended the stock")
+	}
+	band_call(t, sim, role_issuer, true, "set_stock_status", "2024-01-01T00:00:04Z", "s1", stock_suspended)
+	band_call(t, sim, role_issuer, false, "set_stock_status", "2024-01-01T00:00:05Z", "s1", stock_delisted)
+	band_call(t, sim, role_admin, true, "set_stock_status", "2024-01-01T00:00:06Z", "s1", stock_delisted)
+}
+
+func TestRedeemOnlyActiveOrDelisted(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_issuer, true, "set_stock_status", "2024-01-01T00:00:03Z", "s1", stock_suspended)
+	band_call(t, sim, role_issuer, false, "redeem", "2024-01-01T00:00:04Z", "s1", "u1", "10")
+	band_call(t, sim, role_admin, true, "set_stock_status", "2024-01-01T00:00:05Z", "s1", stock_delisted)
+	band_call(t, sim, role_issuer, false, "subscribe", "2024-01-01T00:00:06Z", "s1", "u1", "1000")
+	band_call(t, sim, role_issuer, true, "redeem", "2024-01-01T00:00:06Z", "s1", "u1", "10")
+}
+
+func TestUpdatePriceReservedToCreator(t *testing.T) {
+	sim := band_sim(t)
+	call := ScriptCall{Function: "update_price", Args: []string{"s1", "101"}, Timestamp: "2024-01-01T00:00:03Z", User: "u2"}
+	if result := sim.run(call, role_issuer, "Org1MSP"); result.Status == 200 {
+		t.Fatal("another issuer set the price")
+	}
+	band_call(t, sim, role_issuer, true, "update_price", "2024-01-01T00:00:04Z", "s1", "101")
+}
+
+func TestNewStockHasDefaultBand(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_stock", "2024-01-01T00:00:03Z", "s2", "DEF", "1000", "100", "u1")
+	band_call(t, sim, role_admin, false, "init_transaction", "2024-01-01T00:00:04Z", "t1", "s2", "5", "u1", "u2", "2024-01-01", "108")
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:04Z", "t1", "s2", "5", "u1", "u2", "2024-01-01", "104")
+}
+
+func TestInitStockKeepsUndecodableStock(t *testing.T) {
+	sim := band_sim(t)
+	key, _ := entity_key(sim.stub, stock_namespace, "s2")
+	sim.state.put(key, []byte(`{"docType":"stock","version":99,"id":"s2"}`))
+	band_call(t, sim, role_admin, false, "init_stock", "2024-01-01T00:00:03Z", "s2", "DEF", "1000", "100", "u1")
+	if value := string(sim.state.get(key)); !strings.Contains(value, `"version":99`) {
+		t.Fatalf("stock overwritten - %s", value)
+	}
+}
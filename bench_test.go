@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Benchmarks run on a simulator populated by the load generator. The load is small by default,
+// set BENCH_USERS, BENCH_STOCKS and BENCH_TRADES to measure at production size:
+//
+//	BENCH_USERS=100000 BENCH_TRADES=1000000 go test -run - -bench . -benchtime 200x
+
+var bench_gen *LoadGen
+
+// Bench size - a load parameter from the environment
+func bench_size(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Bench load - the populated simulator shared by every benchmark
+func bench_load(b *testing.B) *LoadGen {
+	if bench_gen != nil {
+		return bench_gen
+	}
+	log_output = ioutil.Discard
+	defer func() { log_output = nil }()
+
+	spec := LoadSpec{Users: bench_size("BENCH_USERS", 1000), Stocks: bench_size("BENCH_STOCKS", 10),
+		Trades: bench_size("BENCH_TRADES", 10000), Compact: 1000, Seed: 1}
+	gen, err := new_load_gen(spec)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bench_gen = gen
+	return gen
+}
+
+// Bench function - call a function b.N times and report its state access and response size per call
+func bench_function(b *testing.B, name string, args func(gen *LoadGen) []string) {
+	gen := bench_load(b)
+	log_output = ioutil.Discard
+	defer func() { log_output = nil }()
+
+	b.ResetTimer()
+	stats := gen.measure(name, b.N, func() []string { return args(gen) })
+	b.StopTimer()
+	if stats.Failed > 0 {
+		b.Fatalf("%s failed %d of %d calls", name, stats.Failed, stats.Calls)
+	}
+	b.ReportMetric(stats.Reads, "reads/op")
+	b.ReportMetric(stats.Writes, "writes/op")
+	b.ReportMetric(stats.ResponseBytes, "resp-B/op")
+}
+
+func BenchmarkInitTransaction(b *testing.B) {
+	bench_function(b, "init_transaction", func(gen *LoadGen) []string { return gen.next_trade() })
+}
+
+func BenchmarkGetListUserHaveStockById(b *testing.B) {
+	bench_function(b, "get_list_user_have_stock_by_id", func(gen *LoadGen) []string {
+		return []string{load_stock(gen.rand.Intn(gen.spec.Stocks))}
+	})
+}
+
+func BenchmarkGetPortfolio(b *testing.B) {
+	bench_function(b, "get_portfolio", func(gen *LoadGen) []string {
+		return []string{load_user(gen.rand.Intn(gen.spec.Users)), "true"}
+	})
+}
+
+func BenchmarkGetListTransactionByUser(b *testing.B) {
+	bench_function(b, "get_list_transaction_by_user", func(gen *LoadGen) []string {
+		return []string{load_user(gen.rand.Intn(gen.spec.Users))}
+	})
+}
+
+func BenchmarkSearchTransactions(b *testing.B) {
+	bench_function(b, "search_transactions", func(gen *LoadGen) []string {
+		return []string{`{"stock_id":"` + load_stock(gen.rand.Intn(gen.spec.Stocks)) + `","sort":"desc","page_size":50}`}
+	})
+}
+
+func BenchmarkGetCandles(b *testing.B) {
+	bench_function(b, "get_candles", func(gen *LoadGen) []string {
+		return []string{load_stock(gen.rand.Intn(gen.spec.Stocks)), "1d", load_time(0), load_time(gen.trades)}
+	})
+}
+
+func BenchmarkCompactBalance(b *testing.B) {
+	bench_function(b, "compact_balance", func(gen *LoadGen) []string {
+		return []string{load_user(gen.rand.Intn(gen.spec.Users))}
+	})
+}
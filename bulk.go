@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- ItemError ----- //
+type ItemError struct {
+	Index int    `json:"index"` // vị trí trong mảng đầu vào
+	Id    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// Bulk errors - report every rejected item, nothing is written or returned when any item fails
+func bulk_errors(stub shim.ChaincodeStubInterface, errs []ItemError) pb.Response {
+	type BulkErrors struct {
+		Errors []ItemError `json:"errors"`
+	}
+	errsAsBytes, _ := json.Marshal(BulkErrors{Errors: errs})
+	log_warning(stub, "bulk rejected", "invalid", len(errs))
+	return shim.Error(string(errsAsBytes))
+}
+
+// Default number - an optional number of a bulk item, zero when absent
+func default_number(number json.Number) string {
+	if len(number) == 0 {
+		return "0"
+	}
+	return number.String()
+}
+
+// Bulk Init Users - create many users in one transaction, all or nothing
+func bulk_init_users(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type UserItem struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+	var items []UserItem
+	log_debug(stub, "starting")
+
+	err := json.Unmarshal([]byte(args[0]), &items)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of {id, name} - " + err.Error())
+	}
+
+	var users []User
+	var errs []ItemError
+	seen := make(map[string]bool)
+	for i, item := range items {
+		user, err := build_user(stub, []string{item.Id, item.Name})
+		if err == nil && seen[item.Id] {
+			err = errors.New("This user is repeated in the batch - " + item.Id)
+		}
+		if err != nil {
+			errs = append(errs, ItemError{Index: i, Id: item.Id, Error: err.Error()})
+			continue
+		}
+		seen[item.Id] = true
+		users = append(users, user)
+	}
+	if len(errs) > 0 {
+		return bulk_errors(stub, errs)
+	}
+
+	uow := new_unit_of_work(stub)
+	for _, user := range users {
+		userAsBytes, _ := json.Marshal(user)
+		err = put_entity(uow, user_namespace, user.Id, userAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = uow.commit()
+	if err != nil {
+		log_error(stub, "could not store user", "err", err)
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "users created", "count", len(users))
+	return shim.Success(nil)
+}
+
+// Bulk Init Stocks - create many stocks in one transaction, all or nothing
+func bulk_init_stocks(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type StockItem struct {
+		Id         string      `json:"id"`
+		Code       string      `json:"code"`
+		Count      json.Number `json:"count"`
+		Price      json.Number `json:"price"`
+		UserId     string      `json:"user_id"`
+		PriceScale json.Number `json:"price_scale"`
+		UnitScale  json.Number `json:"unit_scale"`
+		MinLot     json.Number `json:"min_lot"`
+	}
+	var items []StockItem
+	log_debug(stub, "starting")
+
+	err := json.Unmarshal([]byte(args[0]), &items)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of {id, code, count, price, user_id, price_scale, unit_scale, min_lot} - " + err.Error())
+	}
+
+	var stocks []Stock
+	var errs []ItemError
+	seen := make(map[string]bool)
+	seen_codes := make(map[string]bool)
+	for i, item := range items {
+		stock_args := []string{item.Id, item.Code, item.Count.String(), item.Price.String(), item.UserId,
+			default_number(item.PriceScale), default_number(item.UnitScale), default_number(item.MinLot)}
+		stock, _, err := build_stock(stub, stock_args)
+		if err == nil && seen[item.Id] {
+			err = errors.New("This stock is repeated in the batch - " + item.Id)
+		}
+		if err == nil && seen_codes[item.Code] {
+			err = errors.New("This stock code is repeated in the batch - " + item.Code)
+		}
+		if err != nil {
+			errs = append(errs, ItemError{Index: i, Id: item.Id, Error: err.Error()})
+			continue
+		}
+		seen[item.Id] = true
+		seen_codes[item.Code] = true
+		stocks = append(stocks, stock)
+	}
+	if len(errs) > 0 {
+		return bulk_errors(stub, errs)
+	}
+
+	// one creator may issue several stocks in the batch, each issue is a delta of its own stock
+	uow := new_unit_of_work(stub)
+	for _, stock := range stocks {
+		stockAsBytes, _ := json.Marshal(stock)
+		err = put_entity(uow, stock_namespace, stock.Id, stockAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = put_stock_code(uow, stock)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = update_wallet(uow, stock.Creator.Id, stock, stock.Count, 0, "issue", stock.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = uow.commit()
+	if err != nil {
+		log_error(stub, "could not store stock", "err", err)
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "stocks created", "count", len(stocks))
+	return shim.Success(nil)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Bulk errors of - the rejected items reported by a failed bulk call
+func bulk_errors_of(t *testing.T, message string) []ItemError {
+	t.Helper()
+	var rejected struct {
+		Errors []ItemError `json:"errors"`
+	}
+	err := json.Unmarshal([]byte(message), &rejected)
+	if err != nil {
+		t.Fatalf("not a list of item errors - %s", message)
+	}
+	return rejected.Errors
+}
+
+func TestBulkInitUsersIsAllOrNothing(t *testing.T) {
+	sim := band_sim(t)
+	errs := bulk_errors_of(t, band_call(t, sim, role_admin, false, "bulk_init_users", "2024-01-01T00:00:03Z",
+		`[{"id":"u3","name":"C"},{"id":"u1","name":"A"},{"id":"u3","name":"D"},{"id":"u4","name":""}]`))
+	if len(errs) != 3 || errs[0].Index != 1 || errs[1].Index != 2 || errs[2].Index != 3 {
+		t.Fatalf("unexpected errors - %+v", errs)
+	}
+	band_call(t, sim, role_admin, false, "read_user", "2024-01-01T00:00:04Z", "u3")
+
+	band_call(t, sim, role_admin, true, "bulk_init_users", "2024-01-01T00:00:05Z", `[{"id":"u3","name":"C"},{"id":"u4","name":"D"}]`)
+	band_call(t, sim, role_admin, true, "read_user", "2024-01-01T00:00:06Z", "u4")
+}
+
+func TestBulkInitStocksIssuesEveryStock(t *testing.T) {
+	sim := band_sim(t)
+	errs := bulk_errors_of(t, band_call(t, sim, role_admin, false, "bulk_init_stocks", "2024-01-01T00:00:03Z",
+		`[{"id":"s2","code":"DEF","count":10,"price":5,"user_id":"u2"},{"id":"s3","code":"DEF","count":10,"price":5,"user_id":"u2"},`+
+			`{"id":"s4","code":"GHI","count":10,"price":5,"user_id":"nobody"}]`))
+	if len(errs) != 2 || errs[0].Id != "s3" || errs[1].Id != "s4" {
+		t.Fatalf("unexpected errors - %+v", errs)
+	}
+	band_call(t, sim, role_admin, false, "read_stock", "2024-01-01T00:00:04Z", "s2")
+
+	band_call(t, sim, role_admin, true, "bulk_init_stocks", "2024-01-01T00:00:05Z",
+		`[{"id":"s2","code":"DEF","count":10,"price":5,"user_id":"u2"},{"id":"s3","code":"GHI","count":"2.5","price":"1.25","user_id":"u2","price_scale":2,"unit_scale":1}]`)
+	var portfolio struct {
+		Positions []struct {
+			Id    string `json:"id"`
+			Count Amount `json:"count"`
+		} `json:"positions"`
+	}
+	err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "get_portfolio", "2024-01-01T00:00:06Z", "u2")), &portfolio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(portfolio.Positions) != 2 || portfolio.Positions[0].Count != 10 || portfolio.Positions[1].Count != 25 {
+		t.Fatalf("issues not credited - %+v", portfolio)
+	}
+}
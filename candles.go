@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key of the candles of a stock by day. Each priced trade writes its own one trade candle
+// under a third attribute, the trade id, so concurrent trades of a stock never touch the same key, and
+// get_candles folds them. Keys written before carry the whole day candle without the trade id
+const candle_by_day = "candle~stock~day"
+
+// Day layout of candle keys
+const day_layout = "2006-01-02"
+
+// ----- Candle ----- //
+type Candle struct {
+	ObjectType string `json:"docType"` // field for couchdb
+	StockId    string `json:"stock_id"`
+	Start      string `json:"start"` // ngày bắt đầu của chu kỳ
+	Open       Amount `json:"open"`
+	High       Amount `json:"high"`
+	Low        Amount `json:"low"`
+	Close      Amount `json:"close"`
+	Volume     Amount `json:"volume"`     // tổng số lượng khớp
+	OpenTime   string `json:"open_time"`  // thời gian giao dịch đầu tiên
+	CloseTime  string `json:"close_time"` // thời gian giao dịch cuối cùng
+}
+
+// Merge candle - fold a trade or a shorter candle into a candle, trades may arrive out of time order
+func merge_candle(candle *Candle, other Candle) error {
+	if candle.Volume == 0 {
+		*candle = Candle{ObjectType: "candle", StockId: other.StockId, Start: candle.Start,
+			Open: other.Open, High: other.High, Low: other.Low, Close: other.Close,
+			Volume: other.Volume, OpenTime: other.OpenTime, CloseTime: other.CloseTime}
+		return nil
+	}
+	if other.OpenTime < candle.OpenTime {
+		candle.Open = other.Open
+		candle.OpenTime = other.OpenTime
+	}
+	if other.CloseTime >= candle.CloseTime {
+		candle.Close = other.Close
+		candle.CloseTime = other.CloseTime
+	}
+	if other.High > candle.High {
+		candle.High = other.High
+	}
+	if other.Low < candle.Low {
+		candle.Low = other.Low
+	}
+	volume, err := add_amount(candle.Volume, other.Volume)
+	if err != nil {
+		return err
+	}
+	candle.Volume = volume
+	return nil
+}
+
+// Update candle - record a priced trade as a candle of its own under its stock and day, trades without price
+// or with a time that cannot be parsed are left out of the candles. The key is only written, never read
+func update_candle(stub shim.ChaincodeStubInterface, trade Trade) error {
+	if trade.Price <= 0 {
+		return nil
+	}
+	when, err := parse_time(trade.Time)
+	if err != nil {
+		return nil
+	}
+
+	day := when.Format(day_layout)
+	candleKey, err := stub.CreateCompositeKey(candle_by_day, []string{trade.Stock.Id, day, trade.Id})
+	if err != nil {
+		return err
+	}
+
+	at := when.Format(index_time_layout)
+	candle := Candle{ObjectType: "candle", StockId: trade.Stock.Id, Start: day, Open: trade.Price, High: trade.Price,
+		Low: trade.Price, Close: trade.Price, Volume: trade.Stock.Count, OpenTime: at, CloseTime: at}
+	candleAsBytes, _ := json.Marshal(candle)
+	return stub.PutState(candleKey, candleAsBytes)
+}
+
+// Interval start - the first day of the interval (1d, 1w starting Monday, 1M) containing a day
+func interval_start(day time.Time, interval string) string {
+	switch interval {
+	case "1w":
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset).Format(day_layout)
+	case "1M":
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC).Format(day_layout)
+	}
+	return day.Format(day_layout)
+}
+
+// Get candles - open, high, low, close and volume of a stock per interval (1d, 1w or 1M) between two days
+func get_candles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ListCandle struct {
+		Candles []Candle `json:"candles"`
+	}
+
+	stock_id := args[0]
+	interval := args[1]
+	if interval != "1d" && interval != "1w" && interval != "1M" {
+		return shim.Error("interval must be '1d', '1w' or '1M'")
+	}
+	from, err := parse_time(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := parse_time(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	first := from.Format(day_layout)
+	last := to.Format(day_layout)
+
+	_, err = get_stock(stub, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+
+	candleIterator, err := stub.GetStateByPartialCompositeKey(candle_by_day, []string{stock_id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer candleIterator.Close()
+
+	// the candles of the trades and the day candles written before them come in day order,
+	// so each interval is complete when the next one starts
+	var listCandle ListCandle
+	var current Candle
+	for candleIterator.HasNext() {
+		aKeyValue, err := candleIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var day Candle
+		err = json.Unmarshal(aKeyValue.Value, &day)
+		if err != nil {
+			return shim.Error("Failed to decode candle - " + err.Error())
+		}
+		if day.Start < first || day.Start > last {
+			continue
+		}
+
+		date, _ := time.Parse(day_layout, day.Start)
+		start := interval_start(date, interval)
+		if current.Volume > 0 && current.Start != start {
+			listCandle.Candles = append(listCandle.Candles, current)
+			current = Candle{}
+		}
+		current.Start = start
+		err = merge_candle(&current, day)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if current.Volume > 0 {
+		listCandle.Candles = append(listCandle.Candles, current)
+	}
+	log_debug(stub, "candles", "stock_id", stock_id, "interval", interval, "count", len(listCandle.Candles))
+
+	//change to array of bytes
+	listCandleAsBytes, _ := json.Marshal(listCandle)
+	return shim.Success(listCandleAsBytes)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Issuer role manages the units of open-ended funds
+const role_issuer = "issuer"
+
+// Composite key of a change of the units issued by a fund. Subscriptions and redemptions write one under a key
+// of their transaction instead of rewriting the stock, so they do not conflict with each other or with a trade
+// of the fund in the same block. The units issued are the count of the stock plus these changes, see with_issued
+const issue_by_stock = "issue~stock~tx~cause"
+
+// Put issue - record a change of the units issued by a fund, a blind write
+func put_issue(stub shim.ChaincodeStubInterface, change Delta) error {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	when, err := ptypes.Timestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	change.ObjectType = "issue"
+	change.TxId = stub.GetTxID()
+	change.Time = when.UTC().Format(index_time_layout)
+
+	issueKey, err := stub.CreateCompositeKey(issue_by_stock, []string{change.StockId, change.TxId, change.Cause})
+	if err != nil {
+		return err
+	}
+	changeAsBytes, _ := json.Marshal(change)
+	return stub.PutState(issueKey, changeAsBytes)
+}
+
+// With issued - add the recorded changes of the units issued to the count of a stock, for the calls returning it.
+// Calls that write do not need the count and leave these keys unread
+func with_issued(stub shim.ChaincodeStubInterface, stock *Stock) error {
+	issueIterator, err := stub.GetStateByPartialCompositeKey(issue_by_stock, []string{stock.Id})
+	if err != nil {
+		return err
+	}
+	defer issueIterator.Close()
+
+	for issueIterator.HasNext() {
+		aKeyValue, err := issueIterator.Next()
+		if err != nil {
+			return err
+		}
+		var change Delta
+		err = json.Unmarshal(aKeyValue.Value, &change)
+		if err != nil {
+			return errors.New("Failed to decode issue change - " + err.Error())
+		}
+		stock.Count, err = add_amount(stock.Count, change.Count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Below lot - whether a position is dust: more than zero but less than the minimum lot of its stock
+func below_lot(stock Stock, count Amount) bool {
+	return count > 0 && count < stock.MinLot
+}
+
+// Subscribe - issue new units of a fund to a user for an invested amount at the current price (NAV).
+// Units are rounded down to the unit scale of the stock, the part of the amount that buys less than
+// one smallest unit is returned as residual
+func subscribe(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Subscription struct {
+		StockId  string `json:"stock_id"`
+		UserId   string `json:"user_id"`
+		Units    Amount `json:"units"`    // theo unit_scale
+		Invested Amount `json:"invested"` // theo price_scale
+		Residual Amount `json:"residual"` // phần tiền thừa, theo price_scale
+	}
+	log_debug(stub, "starting")
+
+	stock_id := args[0]
+	user_id := args[1]
+	uow := new_unit_of_work(stub)
+
+	stock, err := get_stock(uow, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+	user, err := get_user(uow, user_id)
+	if err != nil {
+		return shim.Error("This user does not exist - " + user_id)
+	}
+	err = check_active(stock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if stock.Price <= 0 {
+		return shim.Error("This stock has no price - " + stock_id)
+	}
+
+	amount, err := parse_amount(args[2], stock.PriceScale)
+	if err != nil || amount <= 0 {
+		return shim.Error("3rd argument must be a positive numeric string")
+	}
+
+	var subscription Subscription
+	subscription.StockId = stock.Id
+	subscription.UserId = user.Id
+
+	// units = amount / price at the unit scale, rounded down
+	subscription.Units, err = mul_div_amount(amount, pow10(stock.UnitScale), stock.Price)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if subscription.Units <= 0 || subscription.Units < stock.MinLot {
+		return shim.Error("The amount buys less than the minimum lot of " + format_amount(stock.MinLot, stock.UnitScale))
+	}
+	invested, err := mul_amount(subscription.Units, stock.Price)
+	if err == nil {
+		subscription.Invested, err = rescale_amount(invested, stock.UnitScale+stock.PriceScale, stock.PriceScale, round_half_up)
+	}
+	if err == nil {
+		subscription.Residual, err = sub_amount(amount, subscription.Invested)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = put_issue(uow, Delta{UserId: user.Id, StockId: stock.Id, Count: subscription.Units, Cause: "subscribe", Ref: stock.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = update_wallet(uow, user.Id, stock, subscription.Units, 0, "subscribe", stock.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = uow.commit()
+	if err != nil {
+		log_error(stub, "could not store subscription", "err", err)
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "subscribed", "user_id", user.Id, "stock_id", stock.Id, "units", format_amount(subscription.Units, stock.UnitScale))
+	subscriptionAsBytes, _ := json.Marshal(subscription)
+	return shim.Success(subscriptionAsBytes)
+}
+
+// Redeem - cancel units of a fund held by a user at the current price (NAV), units may be "all".
+// Proceeds are rounded down to the price scale, a remainder below the minimum lot is redeemed with the units.
+// A delisted fund is wound down: it no longer issues units but its holders may still redeem them at the last price,
+// a suspended or halted fund does neither
+func redeem(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Redemption struct {
+		StockId  string `json:"stock_id"`
+		UserId   string `json:"user_id"`
+		Units    Amount `json:"units"`    // theo unit_scale
+		Proceeds Amount `json:"proceeds"` // theo price_scale
+		Dust     Amount `json:"dust"`     // phần lẻ dưới lô tối thiểu đã được mua lại
+	}
+	log_debug(stub, "starting")
+
+	stock_id := args[0]
+	user_id := args[1]
+	uow := new_unit_of_work(stub)
+
+	stock, err := get_stock(uow, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+	user, err := get_user(uow, user_id)
+	if err != nil {
+		return shim.Error("This user does not exist - " + user_id)
+	}
+	if stock.Status != stock_delisted {
+		err = check_active(stock)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	holding, err := get_holding(uow, user, stock.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	held := holding.Count
+	var redemption Redemption
+	redemption.StockId = stock.Id
+	redemption.UserId = user.Id
+	if args[2] == "all" {
+		redemption.Units = held
+	} else {
+		redemption.Units, err = parse_amount(args[2], stock.UnitScale)
+		if err != nil || redemption.Units <= 0 {
+			return shim.Error("3rd argument must be a positive numeric string or 'all'")
+		}
+	}
+	if redemption.Units <= 0 || redemption.Units > held {
+		return shim.Error("The amount in the wallet is not enough")
+	}
+	if below_lot(stock, held-redemption.Units) {
+		redemption.Dust = held - redemption.Units
+		redemption.Units = held
+	}
+
+	proceeds, err := mul_amount(redemption.Units, stock.Price)
+	if err == nil {
+		redemption.Proceeds, err = rescale_amount(proceeds, stock.UnitScale+stock.PriceScale, stock.PriceScale, round_down)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = put_issue(uow, Delta{UserId: user.Id, StockId: stock.Id, Count: -redemption.Units, Cause: "redeem", Ref: stock.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = update_wallet(uow, user.Id, stock, redemption.Units, 1, "redeem", stock.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = uow.commit()
+	if err != nil {
+		log_error(stub, "could not store redemption", "err", err)
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "redeemed", "user_id", user.Id, "stock_id", stock.Id, "units", format_amount(redemption.Units, stock.UnitScale))
+	redemptionAsBytes, _ := json.Marshal(redemption)
+	return shim.Success(redemptionAsBytes)
+}
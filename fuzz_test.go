@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Fuzz targets: go test -run - -fuzz FuzzInvoke (one target per run). Every run loads a simulator,
+// add -fuzzminimizetime 5s so minimizing a new input does not stall fuzzing for a minute.
+// Without -fuzz the seed inputs run as ordinary tests
+
+// Fuzz load - a small populated simulator, with chaincode logs discarded
+func fuzz_load(t *testing.T) *LoadGen {
+	log_output = ioutil.Discard
+	t.Cleanup(func() { log_output = nil })
+	gen, err := new_load_gen(LoadSpec{Users: 4, Stocks: 2, Trades: 20, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gen
+}
+
+// Check invariants - audit_state must find no issue: every balance positive, every stock conserved
+func check_invariants(t *testing.T, sim *Simulator, after string) {
+	result := sim.run(ScriptCall{Function: "audit_state"}, role_admin, "Org1MSP")
+	if result.Status != 200 {
+		t.Fatalf("audit_state failed after %s - %s", after, result.Message)
+	}
+	var report AuditReport
+	err := json.Unmarshal(result.Payload, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok {
+		t.Fatalf("invariants broken after %s - %+v", after, report.Issues)
+	}
+}
+
+// FuzzInvoke - any registered function with any arguments, passed through Invoke as the admin, must not panic
+// and must leave the state consistent. The function is picked by its index in the registry so every entry point
+// is reached, seeds are given by name. Arguments are separated by newlines
+func FuzzInvoke(f *testing.F) {
+	seeds := [][2]string{
+		{"init_user", "u9\nEve"},
+		{"init_user", "u9\n"},
+		{"init_stock", "s9\nNEW\n100\n10\nu1"},
+		{"init_stock", "s9\nNEW\n-100\n10\nu1"},
+		{"init_stock", "s9\nNEW\n100.5\n10.25\nu1\n2\n1\n0.5"},
+		{"update_price", "s0\n12"},
+		{"update_price", "s0\n-1"},
+		{"update_price", "s0\n0"},
+		{"set_price_band", "s0\n700\n500"},
+		{"set_price_band", "s0\n100\n700\n0"},
+		{"resume_stock", "s0"},
+		{"init_transaction", "t99\ns0\n5\nu0\nu1\n2024-01-02\n10"},
+		{"init_transaction", "t99\ns0\n-5\nu1\nu2\n2024-01-02"},
+		{"init_transaction", "t99\ns0\n5\nu1\nu1\n2024-01-02"},
+		{"subscribe", "s0\nu1\n100"},
+		{"redeem", "s0\nu1\nall"},
+		{"redeem", "s0\nu3\n99999999999999999999"},
+		{"compact_balance", "u0"},
+		{"bulk_init_users", `[{"id":"u7","name":"A"},{"id":"u7","name":"B"}]`},
+		{"bulk_init_stocks", `[{"id":"s7","code":"X","count":-1,"price":1,"user_id":"u1"}]`},
+		{"search_transactions", `{"stock_id":"s0","min_count":"1","page_size":-3,"bookmark":"x"}`},
+		{"get_candles", "s0\n1w\n2024-01-01\n2025-01-01"},
+		{"get_portfolio", "u1\ntrue"},
+		{"get_holders_at", "s0\n2024-01-01T00:00:10Z"},
+		{"migrate_state", "1"},
+		{"list_outdated", "user\n2"},
+		{"upgrade_entities", "trade\n[\"t1\",\"nobody\"]"},
+		{"describe_api", ""},
+		{"read_stock", "s0"},
+		{"read_users", `["u0","u1","nobody"]`},
+		{"get_stock_by_code", "FUND0"},
+		{"set_stock_status", "s0\nsuspended"},
+		{"get_user_history", "u1\ns0"},
+		{"get_statement", "u1\n2024-01-01\n2025-01-01"},
+		{"get_list_transaction_by_user", "u1"},
+	}
+	for _, seed := range seeds {
+		found := false
+		for i, function := range functions {
+			if function.Name == seed[0] {
+				f.Add(uint(i), seed[1])
+				found = true
+			}
+		}
+		if !found {
+			f.Fatalf("seed function %s is not registered", seed[0])
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, index uint, joined string) {
+		function := functions[index%uint(len(functions))].Name
+		gen := fuzz_load(t)
+		var args []string
+		if len(joined) > 0 {
+			args = strings.Split(joined, "\n")
+		}
+		gen.sim.run(ScriptCall{Function: function, Args: args, Timestamp: load_time(gen.trades)}, role_admin, "Org1MSP")
+		check_invariants(t, gen.sim, function)
+	})
+}
+
+// FuzzDecoders - any stored bytes must be decoded or rejected without panic by the decoders,
+// the readers and the audit, and a decoded document must survive a round trip
+func FuzzDecoders(f *testing.F) {
+	f.Add([]byte(`{"docType":"stock","version":3,"id":"s0","code":"X","count":10,"price":5,"price_scale":0,"unit_scale":0,"min_lot":0,"creator":{"id":"u0","name":"A"}}`))
+	f.Add([]byte(`{"id":"s0","code":"X","count":10,"price":5}`))
+	f.Add([]byte(`{"docType":"user","version":1,"id":"u0","name":"A","wallet":[{"id":"s0","count":-3}]}`))
+	f.Add([]byte(`{"docType":"trade","id":"t1","stock":{"id":"s0","count":1e30}}`))
+	f.Add([]byte(`{"docType":"stock","version":99}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		if stock, err := decode_stock(value); err == nil {
+			again, _ := json.Marshal(stock)
+			if _, err := decode_stock(again); err != nil {
+				t.Fatalf("stock does not survive a round trip - %s", err)
+			}
+		}
+		if user, err := decode_user(value); err == nil {
+			again, _ := json.Marshal(user)
+			if _, err := decode_user(again); err != nil {
+				t.Fatalf("user does not survive a round trip - %s", err)
+			}
+		}
+		if trade, err := decode_trade(value); err == nil {
+			again, _ := json.Marshal(trade)
+			if _, err := decode_trade(again); err != nil {
+				t.Fatalf("trade does not survive a round trip - %s", err)
+			}
+		}
+
+		// the same bytes stored under existing entity keys and under the simple keys of entities
+		// not migrated yet, read through the chaincode
+		gen := fuzz_load(t)
+		for _, entity := range [][2]string{{stock_namespace, "s0"}, {user_namespace, "u1"}, {trade_namespace, "t1"}} {
+			key, _ := entity_key(gen.sim.stub, entity[0], entity[1])
+			gen.sim.state.put(key, value)
+		}
+		for _, key := range []string{"s9", "u9", "t9", "x9"} {
+			gen.sim.state.put(key, value)
+		}
+		for _, call := range []ScriptCall{
+			{Function: "get_portfolio", Args: []string{"u1", "true"}},
+			{Function: "get_list_stock"},
+			{Function: "get_list_user"},
+			{Function: "get_list_transaction"},
+			{Function: "get_list_user_have_stock_by_id", Args: []string{"s0"}},
+			{Function: "read_users", Args: []string{`["u1","u9"]`}},
+			{Function: "init_transaction", Args: []string{"t99", "s0", "1", "u1", "u2", "2024-01-02"}},
+			{Function: "migrate_state", Args: []string{"100"}},
+			{Function: "list_outdated", Args: []string{"user", "100"}},
+			{Function: "upgrade_entities", Args: []string{"user", `["u1","u9"]`}},
+			{Function: "audit_state"},
+		} {
+			gen.sim.run(call, role_admin, "Org1MSP")
+		}
+	})
+}
+
+// FuzzParseAmount - parsed amounts are never negative and format back to a string that parses to the same amount
+func FuzzParseAmount(f *testing.F) {
+	for _, seed := range []string{"0", "12.5", "-1", "1e3", "+4", ".5", "5.", "9223372036854775807", "00012.340", " 1"} {
+		f.Add(seed, 2)
+	}
+
+	f.Fuzz(func(t *testing.T, value string, scale int) {
+		amount, err := parse_amount(value, scale)
+		if err != nil {
+			return
+		}
+		if amount < 0 {
+			t.Fatalf("parse_amount(%q, %d) = %d is negative", value, scale, amount)
+		}
+		again, err := parse_amount(format_amount(amount, scale), scale)
+		if err != nil || again != amount {
+			t.Fatalf("parse_amount(%q, %d) = %d does not round trip through %q", value, scale, amount, format_amount(amount, scale))
+		}
+	})
+}
+
+// FuzzParseTime - any time argument is parsed or rejected without panic
+func FuzzParseTime(f *testing.F) {
+	for _, seed := range []string{"2024-01-02", "2024-01-02 10:00:00", "2024-01-02T10:00:00.5+07:00", "1700000000", "-99999999999999", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		parse_time(value)
+		index_time(value)
+	})
+}
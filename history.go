@@ -0,0 +1,653 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// State at - the value a key had at the given time, from the ledger history of the key.
+// Returns nil when the key did not exist yet or was deleted at that time
+func state_at(stub shim.ChaincodeStubInterface, key string, at time.Time) ([]byte, error) {
+	historyIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer historyIterator.Close()
+
+	var value []byte
+	var latest time.Time
+	found := false
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		modified, err := ptypes.Timestamp(modification.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if modified.After(at) || (found && modified.Before(latest)) {
+			continue
+		}
+		found = true
+		latest = modified
+		if modification.IsDelete {
+			value = nil
+		} else {
+			value = modification.Value
+		}
+	}
+	return value, nil
+}
+
+// Entity at - the document of an entity at the given time. Before migrate_state moved it to its namespace
+// the entity was stored under the simple key of its id
+func entity_at(stub shim.ChaincodeStubInterface, object_type string, id string, at time.Time) ([]byte, error) {
+	key, err := entity_key(stub, object_type, id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := state_at(stub, key, at)
+	if err != nil || value != nil {
+		return value, err
+	}
+
+	value, err = state_at(stub, id, at)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if legacy_type(id, value) != object_type {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// Holding at - the balance of a user in a stock at a past time: the holding key at that time plus the deltas
+// recorded by then and not folded yet. Those are either still pending or listed as folded by a later compaction.
+// Also tells whether the position was still in the wallet embedded in the user document at that time: the first
+// version of the holding key was then written after it by move_wallet, the only writer that folds no delta
+func holding_at(stub shim.ChaincodeStubInterface, user_id string, stock_id string, at time.Time) (Amount, bool, error) {
+	holdingKey, err := stub.CreateCompositeKey(holding_by_user, []string{user_id, stock_id})
+	if err != nil {
+		return 0, false, err
+	}
+	historyIterator, err := stub.GetHistoryForKey(holdingKey)
+	if err != nil {
+		return 0, false, err
+	}
+	defer historyIterator.Close()
+
+	// the version in force at that time, the deltas folded after it and the first version
+	var count Amount
+	var latest time.Time
+	found := false
+	var pending []Delta
+	var first time.Time
+	moved := false
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return 0, false, err
+		}
+		modified, err := ptypes.Timestamp(modification.Timestamp)
+		if err != nil {
+			return 0, false, err
+		}
+		var holding Holding
+		if !modification.IsDelete {
+			err = json.Unmarshal(modification.Value, &holding)
+			if err != nil {
+				return 0, false, errors.New("Failed to decode holding - " + err.Error())
+			}
+		}
+		if first.IsZero() || modified.Before(first) {
+			first = modified
+			moved = !modification.IsDelete && len(holding.Folded) == 0
+		}
+		if modified.After(at) {
+			pending = append(pending, holding.Folded...)
+			continue
+		}
+		if found && modified.Before(latest) {
+			continue
+		}
+		found = true
+		latest = modified
+		count = holding.Count
+	}
+
+	deltas, err := get_deltas(stub, user_id, stock_id)
+	if err != nil {
+		return 0, false, err
+	}
+	pending = append(pending, deltas...)
+
+	when := at.UTC().Format(index_time_layout)
+	for _, delta := range pending {
+		if delta.Time > when {
+			continue
+		}
+		count, err = add_amount(count, delta.Count)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	return count, moved && first.After(at), nil
+}
+
+// Get past holders - the users who have held a stock under a holding key, in id order. Holder index entries
+// written before the index of past holders existed were never pruned, so both indexes are read
+func get_past_holders(stub shim.ChaincodeStubInterface, stock_id string) ([]string, error) {
+	holders := make(map[string]bool)
+	for _, index := range []string{past_holder_by_stock, holder_by_stock} {
+		holderIterator, err := stub.GetStateByPartialCompositeKey(index, []string{stock_id})
+		if err != nil {
+			return nil, err
+		}
+		for holderIterator.HasNext() {
+			aKeyValue, err := holderIterator.Next()
+			if err != nil {
+				holderIterator.Close()
+				return nil, err
+			}
+			_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+			if err != nil {
+				holderIterator.Close()
+				return nil, err
+			}
+			holders[attributes[1]] = true
+		}
+		holderIterator.Close()
+	}
+
+	var user_ids []string
+	for user_id := range holders {
+		user_ids = append(user_ids, user_id)
+	}
+	sort.Strings(user_ids)
+	return user_ids, nil
+}
+
+// Get holders at - the holders of a stock and the count each one held at a past time, rebuilt from the history
+// of the holding keys of its past holders. The history of a user document is only replayed when the position was
+// still embedded in it at that time; a position closed before its wallet was moved left no holding key and is not found
+func get_holders_at(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type UserHaveStock struct {
+		Id    string `json:"id"`
+		Name  string `json:"name"`
+		Count Amount `json:"count"`
+	}
+
+	type ListUser struct {
+		Users []UserHaveStock `json:"users"`
+	}
+
+	stock_id := args[0]
+	at, err := parse_time(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = get_stock(stub, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+
+	var listUser ListUser
+
+	// users who have held the stock under a holding key
+	holders, err := get_past_holders(stub, stock_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, user_id := range holders {
+		count, embedded, err := holding_at(stub, user_id, stock_id, at)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		user, err := get_user(stub, user_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// before its wallet was moved, the position of a user is in the user document
+		if embedded {
+			userAsBytes, err := entity_at(stub, user_namespace, user_id, at)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if userAsBytes == nil {
+				continue
+			}
+			user, err = decode_user(userAsBytes)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			count = 0
+			for _, asset := range user.Wallet {
+				if asset.Id == stock_id {
+					count = asset.Count
+				}
+			}
+		}
+		if count > 0 {
+			listUser.Users = append(listUser.Users, UserHaveStock{Id: user.Id, Name: user.Name, Count: count})
+		}
+	}
+	log_debug(stub, "holders", "stock_id", stock_id, "at", at.Format(time.RFC3339), "count", len(listUser.Users))
+
+	//change to array of bytes
+	listUserAsBytes, _ := json.Marshal(listUser)
+	return shim.Success(listUserAsBytes)
+}
+
+// Cause of the balance changes found in a wallet embedded in a user document, before changes recorded their cause
+const cause_unrecorded = "unrecorded"
+
+// ----- BalanceChange ----- //
+type BalanceChange struct {
+	TxId      string `json:"tx_id"`
+	Time      string `json:"time"`
+	StockId   string `json:"stock_id"`
+	Cause     string `json:"cause"`   // issue, buy, sell, subscribe, redeem hoặc unrecorded
+	Ref       string `json:"ref"`     // id giao dịch hoặc chứng chỉ gây ra thay đổi
+	Count     Amount `json:"count"`   // số lượng thay đổi, âm khi giảm
+	Balance   Amount `json:"balance"` // số dư sau thay đổi
+	UnitScale int    `json:"unit_scale"`
+}
+
+// Wallet changes - the balance changes of a user while the wallet was embedded in the user document, from the
+// history of the user document under its simple key then in its namespace. Ends when the wallet is moved
+// to holding keys, the positions then carry on from the balances moved
+func wallet_changes(stub shim.ChaincodeStubInterface, user_id string) ([]BalanceChange, error) {
+	var changes []BalanceChange
+
+	userKey, err := entity_key(stub, user_namespace, user_id)
+	if err != nil {
+		return nil, err
+	}
+	type Version struct {
+		TxId string
+		Time time.Time
+		User User
+		Raw  int
+	}
+	var versions []Version
+	read_history := func(key string) error {
+		historyIterator, err := stub.GetHistoryForKey(key)
+		if err != nil {
+			return err
+		}
+		defer historyIterator.Close()
+
+		for historyIterator.HasNext() {
+			modification, err := historyIterator.Next()
+			if err != nil {
+				return err
+			}
+			if modification.IsDelete || legacy_type(user_id, modification.Value) != user_namespace {
+				continue
+			}
+			modified, err := ptypes.Timestamp(modification.Timestamp)
+			if err != nil {
+				return err
+			}
+			var header struct {
+				Version int `json:"version"`
+			}
+			err = json.Unmarshal(modification.Value, &header)
+			if err != nil {
+				return errors.New("Failed to decode user " + user_id + " of transaction " + modification.TxId + " - " + err.Error())
+			}
+			user, err := decode_user(modification.Value)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, Version{TxId: modification.TxId, Time: modified, User: user, Raw: header.Version})
+		}
+		return nil
+	}
+	for _, key := range []string{user_id, userKey} {
+		err = read_history(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Time.Before(versions[j].Time)
+	})
+
+	balances := make(map[string]Amount)
+	for _, version := range versions {
+		// from version 2 on the wallet is in holding keys
+		if version.Raw >= 2 {
+			break
+		}
+		counts := make(map[string]Amount)
+		for _, asset := range version.User.Wallet {
+			counts[asset.Id] = asset.Count
+		}
+		var stock_ids []string
+		for stock_id := range counts {
+			stock_ids = append(stock_ids, stock_id)
+		}
+		for stock_id := range balances {
+			if _, found := counts[stock_id]; !found {
+				stock_ids = append(stock_ids, stock_id)
+			}
+		}
+		sort.Strings(stock_ids)
+
+		for _, stock_id := range stock_ids {
+			count, err := sub_amount(counts[stock_id], balances[stock_id])
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				continue
+			}
+			changes = append(changes, BalanceChange{TxId: version.TxId, Time: version.Time.UTC().Format(index_time_layout),
+				StockId: stock_id, Cause: cause_unrecorded, Count: count})
+		}
+		balances = counts
+	}
+	return changes, nil
+}
+
+// Folded deltas - the balance changes folded into every version of a holding key
+func folded_deltas(stub shim.ChaincodeStubInterface, holdingKey string) ([]Delta, error) {
+	historyIterator, err := stub.GetHistoryForKey(holdingKey)
+	if err != nil {
+		return nil, err
+	}
+	defer historyIterator.Close()
+
+	var deltas []Delta
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if modification.IsDelete {
+			continue
+		}
+		var holding Holding
+		err = json.Unmarshal(modification.Value, &holding)
+		if err != nil {
+			return nil, errors.New("Failed to decode holding - " + err.Error())
+		}
+		deltas = append(deltas, holding.Folded...)
+	}
+	return deltas, nil
+}
+
+// User changes - every balance change of a user, of one stock or of every stock when stock_id is empty, in time order
+// with the balance after each change. Changes recorded as deltas carry their cause and reference, those made while
+// the wallet was embedded in the user document are found from the history of that document and have no recorded cause
+func user_changes(stub shim.ChaincodeStubInterface, user_id string, stock_id string) ([]BalanceChange, error) {
+	changes, err := wallet_changes(stub, user_id)
+	if err != nil {
+		return nil, err
+	}
+
+	// ---- deltas folded into the versions of each holding, and those still pending --- //
+	keys := []string{user_id}
+	if len(stock_id) > 0 {
+		keys = append(keys, stock_id)
+	}
+	var deltas []Delta
+	holdingIterator, err := stub.GetStateByPartialCompositeKey(holding_by_user, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer holdingIterator.Close()
+
+	for holdingIterator.HasNext() {
+		aKeyValue, err := holdingIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		folded, err := folded_deltas(stub, aKeyValue.Key)
+		if err != nil {
+			return nil, err
+		}
+		deltas = append(deltas, folded...)
+	}
+	pending, err := get_deltas(stub, user_id, stock_id)
+	if err != nil {
+		return nil, err
+	}
+	deltas = append(deltas, pending...)
+
+	seen := make(map[string]bool)
+	for _, delta := range deltas {
+		key := delta.StockId + "/" + delta.TxId + "/" + delta.Cause
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		changes = append(changes, BalanceChange{TxId: delta.TxId, Time: delta.Time, StockId: delta.StockId,
+			Cause: delta.Cause, Ref: delta.Ref, Count: delta.Count})
+	}
+
+	// ---- balances --- //
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Time != changes[j].Time {
+			return changes[i].Time < changes[j].Time
+		}
+		return changes[i].TxId < changes[j].TxId
+	})
+	var result []BalanceChange
+	balances := make(map[string]Amount)
+	stocks := make(map[string]Stock)
+	for _, change := range changes {
+		if len(stock_id) > 0 && change.StockId != stock_id {
+			continue
+		}
+		stock, found := stocks[change.StockId]
+		if !found {
+			stock, err = get_stock(stub, change.StockId)
+			if err != nil {
+				return nil, err
+			}
+			stocks[change.StockId] = stock
+		}
+		change.Balance, err = add_amount(balances[change.StockId], change.Count)
+		if err != nil {
+			return nil, err
+		}
+		change.UnitScale = stock.UnitScale
+		balances[change.StockId] = change.Balance
+		result = append(result, change)
+	}
+	return result, nil
+}
+
+// Get user history - every balance change of a user, of one stock or of every stock, see user_changes
+func get_user_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type History struct {
+		UserId  string          `json:"user_id"`
+		Changes []BalanceChange `json:"changes"`
+	}
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 2")
+	}
+
+	user_id := args[0]
+	stock_id := ""
+	if len(args) > 1 {
+		stock_id = args[1]
+	}
+	_, err := get_user(stub, user_id)
+	if err != nil {
+		return shim.Error("This user does not exist - " + user_id)
+	}
+
+	history := History{UserId: user_id}
+	history.Changes, err = user_changes(stub, user_id, stock_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	log_debug(stub, "user history", "user_id", user_id, "changes", len(history.Changes))
+
+	//change to array of bytes
+	historyAsBytes, _ := json.Marshal(history)
+	return shim.Success(historyAsBytes)
+}
+
+// ----- Movement ----- //
+type Movement struct {
+	TxId         string `json:"tx_id"`
+	Time         string `json:"time"`
+	Cause        string `json:"cause"`
+	Ref          string `json:"ref"`          // id giao dịch hoặc chứng chỉ gây ra thay đổi
+	Counterparty string `json:"counterparty"` // người mua hoặc người bán của giao dịch, rỗng nếu không có
+	Count        Amount `json:"count"`
+	Balance      Amount `json:"balance"`
+}
+
+// ----- StockStatement ----- //
+type StockStatement struct {
+	StockId    string     `json:"stock_id"`
+	Code       string     `json:"code"`
+	UnitScale  int        `json:"unit_scale"`
+	Opening    Amount     `json:"opening"` // số dư đầu kỳ
+	Movements  []Movement `json:"movements"`
+	Closing    Amount     `json:"closing"`    // số dư cuối kỳ
+	Current    Amount     `json:"current"`    // số dư hiện tại trong ví
+	Reconciled bool       `json:"reconciled"` // các thay đổi cộng lại bằng số dư hiện tại
+}
+
+// ----- Statement ----- //
+type Statement struct {
+	UserId     string           `json:"user_id"`
+	Name       string           `json:"name"`
+	From       string           `json:"from"`
+	To         string           `json:"to"`
+	Stocks     []StockStatement `json:"stocks"`
+	Reconciled bool             `json:"reconciled"`
+}
+
+// Get statement - the account statement of a user over [from, to): per stock, the opening balance, every movement
+// with its reference and counterparty, and the closing balance. The balance after the last change ever recorded
+// is reconciled against the current wallet. Stocks without balance nor movement in the period are left out
+func get_statement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	user_id := args[0]
+	from, err := parse_time(args[1])
+	if err != nil {
+		return shim.Error("2nd argument - " + err.Error())
+	}
+	to, err := parse_time(args[2])
+	if err != nil {
+		return shim.Error("3rd argument - " + err.Error())
+	}
+	if !from.Before(to) {
+		return shim.Error("The start of the period must be before its end")
+	}
+	user, err := get_user(stub, user_id)
+	if err != nil {
+		return shim.Error("This user does not exist - " + user_id)
+	}
+
+	changes, err := user_changes(stub, user_id, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	statement := Statement{UserId: user.Id, Name: user.Name, From: from.UTC().Format(time.RFC3339), To: to.UTC().Format(time.RFC3339), Reconciled: true}
+	first := from.UTC().Format(index_time_layout)
+	last := to.UTC().Format(index_time_layout)
+	lines := make(map[string]*StockStatement)
+	var stock_ids []string
+	trades := make(map[string]Trade)
+	for _, change := range changes {
+		line, found := lines[change.StockId]
+		if !found {
+			line = &StockStatement{StockId: change.StockId, UnitScale: change.UnitScale}
+			lines[change.StockId] = line
+			stock_ids = append(stock_ids, change.StockId)
+		}
+		line.Current = change.Balance
+		if change.Time < first {
+			line.Opening = change.Balance
+			line.Closing = change.Balance
+			continue
+		}
+		if change.Time >= last {
+			continue
+		}
+
+		movement := Movement{TxId: change.TxId, Time: change.Time, Cause: change.Cause, Ref: change.Ref,
+			Count: change.Count, Balance: change.Balance}
+		if change.Cause == "buy" || change.Cause == "sell" {
+			trade, found := trades[change.Ref]
+			if !found {
+				trade, err = get_transaction(stub, change.Ref)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				trades[change.Ref] = trade
+			}
+			movement.Counterparty = trade.Seller.Id
+			if change.Cause == "sell" {
+				movement.Counterparty = trade.Buyer.Id
+			}
+		}
+		line.Movements = append(line.Movements, movement)
+		line.Closing = change.Balance
+	}
+
+	// positions of the wallet no recorded change accounts for
+	wallet, err := get_wallet(stub, user)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, asset := range wallet {
+		if _, found := lines[asset.Id]; !found {
+			lines[asset.Id] = &StockStatement{StockId: asset.Id}
+			stock_ids = append(stock_ids, asset.Id)
+		}
+	}
+	sort.Strings(stock_ids)
+
+	for _, stock_id := range stock_ids {
+		line := lines[stock_id]
+		stock, err := get_stock(stub, stock_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		line.Code = stock.Code
+		line.UnitScale = stock.UnitScale
+		// line.Current holds the balance after the last change, compared with the wallet
+		asset, err := get_holding(stub, user, stock_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		line.Reconciled = line.Current == asset.Count
+		line.Current = asset.Count
+		if !line.Reconciled {
+			statement.Reconciled = false
+		}
+		if line.Opening == 0 && len(line.Movements) == 0 && line.Closing == 0 && line.Reconciled {
+			continue
+		}
+		statement.Stocks = append(statement.Stocks, *line)
+	}
+	log_debug(stub, "statement", "user_id", user_id, "stocks", len(statement.Stocks))
+
+	//change to array of bytes
+	statementAsBytes, _ := json.Marshal(statement)
+	return shim.Success(statementAsBytes)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// History sim - the band sim where u1 sells 30 of s1 to u2, u2 sells 10 back, compacts its balance
+// then subscribes 5 more units
+func history_sim(t *testing.T) *Simulator {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-02T00:00:00Z", "t1", "s1", "30", "u1", "u2", "2024-01-02", "100")
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-03T00:00:00Z", "t2", "s1", "10", "u2", "u1", "2024-01-03", "100")
+	band_call(t, sim, role_admin, true, "compact_balance", "2024-01-04T00:00:00Z", "u2")
+	band_call(t, sim, role_issuer, true, "subscribe", "2024-01-05T00:00:00Z", "s1", "u2", "500")
+	return sim
+}
+
+func TestUserHistoryKeepsCausesAcrossCompaction(t *testing.T) {
+	sim := history_sim(t)
+	var history struct {
+		Changes []BalanceChange `json:"changes"`
+	}
+	err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "get_user_history", "2024-01-06T00:00:00Z", "u2", "s1")), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BalanceChange{{Cause: "buy", Ref: "t1", Count: 30, Balance: 30}, {Cause: "sell", Ref: "t2", Count: -10, Balance: 20},
+		{Cause: "subscribe", Count: 5, Balance: 25}}
+	if len(history.Changes) != len(want) {
+		t.Fatalf("unexpected history - %+v", history.Changes)
+	}
+	for i, change := range history.Changes {
+		if change.Cause != want[i].Cause || change.Count != want[i].Count || change.Balance != want[i].Balance ||
+			(len(want[i].Ref) > 0 && change.Ref != want[i].Ref) {
+			t.Fatalf("change %d - %+v", i, change)
+		}
+	}
+}
+
+func TestStatementOpensAndClosesThePeriod(t *testing.T) {
+	sim := history_sim(t)
+	var statement Statement
+	err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "get_statement", "2024-01-06T00:00:00Z", "u2", "2024-01-03", "2024-01-05")), &statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statement.Reconciled || len(statement.Stocks) != 1 {
+		t.Fatalf("unexpected statement - %+v", statement)
+	}
+	line := statement.Stocks[0]
+	if line.Code != "ABC" || line.Opening != 30 || line.Closing != 20 || line.Current != 25 || len(line.Movements) != 1 {
+		t.Fatalf("unexpected statement of s1 - %+v", line)
+	}
+	if movement := line.Movements[0]; movement.Ref != "t2" || movement.Counterparty != "u1" || movement.Count != -10 {
+		t.Fatalf("unexpected movement - %+v", movement)
+	}
+
+	band_call(t, sim, role_admin, false, "get_statement", "2024-01-06T00:00:00Z", "u2", "2024-01-05", "2024-01-05")
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite keys of holdings: the position of a user in a stock, the reverse index of the users who hold
+// a stock and the index of the users who have ever held it, which is never pruned and serves get_holders_at.
+// Keeping each position under its own key means trades of different stocks do not touch the same key of a user
+const (
+	holding_by_user      = "holding~user~stock"
+	holder_by_stock      = "holder~stock~user"
+	past_holder_by_stock = "held~stock~user"
+)
+
+// Composite key of a balance change. Every change is written under a key of its own transaction,
+// so credits never read the balance and many trades can credit the same account in one block.
+// Debits still read the balance through a range over the deltas of the position, which Fabric checks again
+// at commit: two debits of the same position in one block, such as two sells by a market maker or two
+// redemptions, conflict and the later one fails with a phantom read, as does a debit following a credit of the
+// same position in the block.
+// The balance of a position is its holding plus the sum of its deltas, compact_balance folds the deltas in
+const delta_by_user = "delta~user~stock~tx~cause"
+
+// ----- Delta ----- //
+type Delta struct {
+	ObjectType string `json:"docType"` // field for couchdb
+	UserId     string `json:"user_id"`
+	StockId    string `json:"stock_id"`
+	Count      Amount `json:"count"` // số lượng thay đổi, âm khi giảm
+	Cause      string `json:"cause"` // issue, buy, sell, subscribe, redeem
+	Ref        string `json:"ref"`   // id giao dịch hoặc chứng chỉ gây ra thay đổi
+	TxId       string `json:"tx_id"`
+	Time       string `json:"time"` // thời gian giao dịch fabric
+}
+
+// ----- Holding ----- //
+type Holding struct {
+	Asset
+	Folded []Delta `json:"folded,omitempty"` // các thay đổi được gộp ở lần compact gần nhất
+}
+
+// Get deltas - the balance changes of a user not folded yet, of one stock or of every stock when stock_id is empty
+func get_deltas(stub shim.ChaincodeStubInterface, user_id string, stock_id string) ([]Delta, error) {
+	keys := []string{user_id}
+	if len(stock_id) > 0 {
+		keys = append(keys, stock_id)
+	}
+	deltaIterator, err := stub.GetStateByPartialCompositeKey(delta_by_user, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer deltaIterator.Close()
+
+	var deltas []Delta
+	for deltaIterator.HasNext() {
+		aKeyValue, err := deltaIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var delta Delta
+		err = json.Unmarshal(aKeyValue.Value, &delta)
+		if err != nil {
+			return nil, errors.New("Failed to decode balance change - " + err.Error())
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas, nil
+}
+
+// Get wallet - every position of a user, from the holding keys and the deltas or, for a user stored before
+// holding keys existed and not migrated yet, from the wallet embedded in the user document
+func get_wallet(stub shim.ChaincodeStubInterface, user User) ([]Asset, error) {
+	if len(user.Wallet) > 0 {
+		return user.Wallet, nil
+	}
+
+	holdingIterator, err := stub.GetStateByPartialCompositeKey(holding_by_user, []string{user.Id})
+	if err != nil {
+		return nil, err
+	}
+	defer holdingIterator.Close()
+
+	positions := make(map[string]Asset)
+	for holdingIterator.HasNext() {
+		aKeyValue, err := holdingIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var asset Asset
+		err = json.Unmarshal(aKeyValue.Value, &asset)
+		if err != nil {
+			return nil, errors.New("Failed to decode holding - " + err.Error())
+		}
+		positions[asset.Id] = asset
+	}
+
+	deltas, err := get_deltas(stub, user.Id, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, delta := range deltas {
+		asset := positions[delta.StockId]
+		asset.Id = delta.StockId
+		asset.Count, err = add_amount(asset.Count, delta.Count)
+		if err != nil {
+			return nil, err
+		}
+		positions[delta.StockId] = asset
+	}
+
+	var wallet []Asset
+	for _, asset := range positions {
+		if asset.Count == 0 {
+			continue
+		}
+		if len(asset.Code) == 0 {
+			stock, err := get_stock(stub, asset.Id)
+			if err != nil {
+				return nil, err
+			}
+			asset.Code = stock.Code
+		}
+		wallet = append(wallet, asset)
+	}
+	sort.Slice(wallet, func(i, j int) bool {
+		return wallet[i].Id < wallet[j].Id
+	})
+	return wallet, nil
+}
+
+// Get holding - the position of a user in a stock, with a zero count when the user holds none
+func get_holding(stub shim.ChaincodeStubInterface, user User, stock_id string) (Asset, error) {
+	asset := Asset{Id: stock_id}
+	if len(user.Wallet) > 0 {
+		for _, position := range user.Wallet {
+			if position.Id == stock_id {
+				return position, nil
+			}
+		}
+		return asset, nil
+	}
+
+	holdingKey, err := stub.CreateCompositeKey(holding_by_user, []string{user.Id, stock_id})
+	if err != nil {
+		return asset, err
+	}
+	holdingAsBytes, err := stub.GetState(holdingKey)
+	if err != nil {
+		return asset, err
+	}
+	if holdingAsBytes != nil {
+		err = json.Unmarshal(holdingAsBytes, &asset)
+		if err != nil {
+			return asset, errors.New("Failed to decode holding - " + err.Error())
+		}
+	}
+
+	deltas, err := get_deltas(stub, user.Id, stock_id)
+	if err != nil {
+		return asset, err
+	}
+	for _, delta := range deltas {
+		asset.Count, err = add_amount(asset.Count, delta.Count)
+		if err != nil {
+			return asset, err
+		}
+	}
+	return asset, nil
+}
+
+// Put holding - store the position of a user, a zero count removes it unless it records folded deltas.
+// The holder index entry follows the count
+func put_holding(stub shim.ChaincodeStubInterface, user_id string, holding Holding) error {
+	holdingKey, err := stub.CreateCompositeKey(holding_by_user, []string{user_id, holding.Id})
+	if err != nil {
+		return err
+	}
+	if holding.Count == 0 && len(holding.Folded) == 0 {
+		err = stub.DelState(holdingKey)
+	} else {
+		holdingAsBytes, _ := json.Marshal(holding)
+		err = stub.PutState(holdingKey, holdingAsBytes)
+	}
+	if err != nil {
+		return err
+	}
+	if holding.Count == 0 {
+		return drop_holder(stub, user_id, holding.Id)
+	}
+	return put_holder(stub, user_id, holding.Id)
+}
+
+// Put holder - write the index entries of a holder, blind writes
+func put_holder(stub shim.ChaincodeStubInterface, user_id string, stock_id string) error {
+	for _, index := range []string{holder_by_stock, past_holder_by_stock} {
+		indexKey, err := stub.CreateCompositeKey(index, []string{stock_id, user_id})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop holder - remove the holder index entry of a closed position, a blind delete. The user stays in the
+// index of past holders. A credit of the position later in the same block writes the entry again, one earlier
+// in the block fails the debit that closed the position with a phantom read
+func drop_holder(stub shim.ChaincodeStubInterface, user_id string, stock_id string) error {
+	holderKey, err := stub.CreateCompositeKey(holder_by_stock, []string{stock_id, user_id})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(holderKey)
+}
+
+// Put delta - record a balance change of a user under a key of the current transaction, without reading the balance.
+// A debit passes the balance it was checked against, a debit of the whole balance closes the position
+func put_delta(stub shim.ChaincodeStubInterface, delta Delta, balance Amount) error {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	when, err := ptypes.Timestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	delta.ObjectType = "delta"
+	delta.TxId = stub.GetTxID()
+	delta.Time = when.UTC().Format(index_time_layout)
+
+	deltaKey, err := stub.CreateCompositeKey(delta_by_user, []string{delta.UserId, delta.StockId, delta.TxId, delta.Cause})
+	if err != nil {
+		return err
+	}
+	deltaAsBytes, _ := json.Marshal(delta)
+	err = stub.PutState(deltaKey, deltaAsBytes)
+	if err != nil {
+		return err
+	}
+	if delta.Count > 0 {
+		return put_holder(stub, delta.UserId, delta.StockId)
+	}
+	if delta.Count < 0 && delta.Count == -balance {
+		return drop_holder(stub, delta.UserId, delta.StockId)
+	}
+	return nil
+}
+
+// Move wallet - move the wallet embedded in a user stored before holding keys existed to holding keys,
+// and store the user as a profile only
+func move_wallet(stub shim.ChaincodeStubInterface, user *User) error {
+	for _, asset := range user.Wallet {
+		err := put_holding(stub, user.Id, Holding{Asset: asset})
+		if err != nil {
+			return err
+		}
+	}
+	user.Wallet = nil
+	user.Version = user_version()
+
+	userAsBytes, _ := json.Marshal(user)
+	return put_entity(stub, user_namespace, user.Id, userAsBytes)
+}
+
+// Fold deltas - fold the pending balance changes of a position into its holding key and remove them,
+// returns the new holding
+func fold_deltas(stub shim.ChaincodeStubInterface, user User, stock Stock) (Holding, error) {
+	var holding Holding
+	asset, err := get_holding(stub, user, stock.Id)
+	if err != nil {
+		return holding, err
+	}
+	holding.Asset = asset
+	holding.Code = stock.Code
+
+	holding.Folded, err = get_deltas(stub, user.Id, stock.Id)
+	if err != nil {
+		return holding, err
+	}
+	if len(holding.Folded) == 0 {
+		return holding, nil
+	}
+	if holding.Count < 0 {
+		return holding, errors.New("The balance of " + user.Id + " in " + stock.Id + " is negative")
+	}
+	for _, delta := range holding.Folded {
+		deltaKey, err := stub.CreateCompositeKey(delta_by_user, []string{delta.UserId, delta.StockId, delta.TxId, delta.Cause})
+		if err != nil {
+			return holding, err
+		}
+		err = stub.DelState(deltaKey)
+		if err != nil {
+			return holding, err
+		}
+	}
+	return holding, put_holding(stub, user.Id, holding)
+}
+
+// Compact balance - fold the pending balance changes of a user into the holding keys,
+// of one stock or of every stock when no stock is given. Called by the user or an admin
+func compact_balance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Compacted struct {
+		Id     string `json:"id"`
+		Count  Amount `json:"count"`
+		Folded int    `json:"folded"` // số thay đổi đã gộp
+	}
+
+	type Result struct {
+		UserId    string      `json:"user_id"`
+		Compacted []Compacted `json:"compacted"`
+	}
+	log_debug(stub, "starting")
+
+	user_id := args[0]
+	err := check_owner(stub, user_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	uow := new_unit_of_work(stub)
+	user, err := get_user(uow, user_id)
+	if err != nil {
+		return shim.Error("This user does not exist - " + user_id)
+	}
+	if len(user.Wallet) > 0 {
+		err = move_wallet(uow, &user)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	var stock_ids []string
+	if len(args) > 1 {
+		stock_ids = append(stock_ids, args[1])
+	} else {
+		deltas, err := get_deltas(uow, user.Id, "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, delta := range deltas {
+			if !contains(stock_ids, delta.StockId) {
+				stock_ids = append(stock_ids, delta.StockId)
+			}
+		}
+	}
+
+	var result Result
+	result.UserId = user.Id
+	for _, stock_id := range stock_ids {
+		stock, err := get_stock(uow, stock_id)
+		if err != nil {
+			return shim.Error("This stock does not exist - " + stock_id)
+		}
+		holding, err := fold_deltas(uow, user, stock)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Compacted = append(result.Compacted, Compacted{Id: stock.Id, Count: holding.Count, Folded: len(holding.Folded)})
+	}
+
+	err = uow.commit()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "compacted", "user_id", user.Id, "positions", len(result.Compacted))
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
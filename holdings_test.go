@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Holding call - run a call as a user with a role and check whether it succeeds
+func holding_call(t *testing.T, sim *Simulator, role string, user string, succeed bool, function string, at string, args ...string) string {
+	t.Helper()
+	result := sim.run(ScriptCall{Function: function, Args: args, Timestamp: at, User: user}, role, "Org1MSP")
+	if (result.Status == 200) != succeed {
+		t.Fatalf("%s %v: status %d - %s", function, args, result.Status, result.Message)
+	}
+	return result.Message + string(result.Payload)
+}
+
+func TestCompactBalanceReservedToOwner(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:03Z", "t1", "s1", "5", "u1", "u2", "2024-01-01", "100")
+
+	holding_call(t, sim, "user", "u1", false, "compact_balance", "2024-01-01T00:00:04Z", "u2")
+	holding_call(t, sim, "user", "", false, "compact_balance", "2024-01-01T00:00:04Z", "u2")
+	var result struct {
+		Compacted []struct {
+			Id     string `json:"id"`
+			Count  Amount `json:"count"`
+			Folded int    `json:"folded"`
+		} `json:"compacted"`
+	}
+	err := json.Unmarshal([]byte(holding_call(t, sim, "user", "u2", true, "compact_balance", "2024-01-01T00:00:05Z", "u2")), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Compacted) != 1 || result.Compacted[0].Count != 5 || result.Compacted[0].Folded != 1 {
+		t.Fatalf("unexpected compaction - %+v", result)
+	}
+	holding_call(t, sim, role_admin, "", true, "compact_balance", "2024-01-01T00:00:06Z", "u1")
+}
+
+// Count keys - the number of stored keys under a partial composite key
+func count_keys(sim *Simulator, object_type string, attributes ...string) int {
+	prefix, _ := sim.stub.CreateCompositeKey(object_type, attributes)
+	count := 0
+	for iterator := sim.state.scan(prefix, prefix+max_key); iterator.HasNext(); count++ {
+		iterator.Next()
+	}
+	return count
+}
+
+func TestCompactBalanceFoldsDeltas(t *testing.T) {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:03Z", "t1", "s1", "30", "u1", "u2", "2024-01-01", "100")
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T00:00:04Z", "t2", "s1", "30", "u2", "u1", "2024-01-01", "100")
+	if count_keys(sim, delta_by_user, "u2", "s1") != 2 || count_keys(sim, holder_by_stock, "s1", "u2") != 0 ||
+		count_keys(sim, past_holder_by_stock, "s1", "u2") != 1 {
+		t.Fatal("closing debit did not drop the holder")
+	}
+
+	var result struct {
+		Compacted []struct {
+			Count  Amount `json:"count"`
+			Folded int    `json:"folded"`
+		} `json:"compacted"`
+	}
+	json.Unmarshal([]byte(holding_call(t, sim, role_admin, "", true, "compact_balance", "2024-01-01T00:00:05Z", "u2")), &result)
+	if len(result.Compacted) != 1 || result.Compacted[0].Count != 0 || result.Compacted[0].Folded != 2 {
+		t.Fatalf("unexpected compaction - %+v", result)
+	}
+	json.Unmarshal([]byte(holding_call(t, sim, role_admin, "", true, "compact_balance", "2024-01-01T00:00:06Z", "u1")), &result)
+	if len(result.Compacted) != 1 || result.Compacted[0].Count != 1000 || result.Compacted[0].Folded != 3 {
+		t.Fatalf("unexpected compaction - %+v", result)
+	}
+	if count_keys(sim, delta_by_user) != 0 || count_keys(sim, holder_by_stock, "s1") != 1 {
+		t.Fatal("deltas left after compaction")
+	}
+	message := band_call(t, sim, role_admin, true, "get_list_user_have_stock_by_id", "2024-01-01T00:00:07Z", "s1")
+	if strings.Contains(message, "u2") || !strings.Contains(message, "u1") {
+		t.Fatalf("unexpected holders - %s", message)
+	}
+}
@@ -3,19 +3,200 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"sort"
 	"strconv"
+	"time"
+	"unicode/utf8"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
+// Bounds of range scans over every simple key, composite keys start with a null character and sort before them
+const (
+	min_key = "\x01"
+	max_key = string(utf8.MaxRune)
+)
+
+// Namespaces of the entity keys, each entity is stored under a composite key of its object type and id
+// so range scans and getters of one type never see another
+const (
+	stock_namespace = "stock"
+	user_namespace  = "user"
+	trade_namespace = "trade"
+)
+
+// Longest id of an entity, ids are made of letters, digits and '-', '_', '.', ':'
+const max_id_length = 32
+
+// Composite key of the code index, each code is held by one stock and its value is the id of that stock
+const stock_by_code = "code~stock"
+
+// Validate id - the id of a new entity must be short and made of letters, digits and '-', '_', '.', ':'
+func validate_id(id string) error {
+	if len(id) == 0 || len(id) > max_id_length {
+		return errors.New("Id must be 1 to " + strconv.Itoa(max_id_length) + " characters - '" + id + "'")
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return errors.New("Id must hold only letters, digits and '-', '_', '.', ':' - '" + id + "'")
+		}
+	}
+	return nil
+}
+
+// Entity key - the key of a stock, user or trade in its namespace
+func entity_key(stub shim.ChaincodeStubInterface, object_type string, id string) (string, error) {
+	return stub.CreateCompositeKey(object_type, []string{id})
+}
+
+// Legacy type - the object type of a document stored under the simple key of its id, before key namespaces.
+// Documents written before they carried a docType are typed by the first letter of their id, as the old range scans did
+func legacy_type(key string, value []byte) string {
+	var header struct {
+		ObjectType string `json:"docType"`
+	}
+	err := json.Unmarshal(value, &header)
+	if err == nil && len(header.ObjectType) > 0 {
+		return header.ObjectType
+	}
+	switch {
+	case len(key) > 0 && key[0] == 's':
+		return stock_namespace
+	case len(key) > 0 && key[0] == 'u':
+		return user_namespace
+	case len(key) > 0 && key[0] == 't':
+		return trade_namespace
+	}
+	return ""
+}
+
+// Get entity - the stored document of an entity, nil when it does not exist. An entity stored before key namespaces
+// is read from the simple key of its id until migrate_state moves it
+func get_entity(stub shim.ChaincodeStubInterface, object_type string, id string) ([]byte, error) {
+	key, err := entity_key(stub, object_type, id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value != nil {
+		return value, err
+	}
+
+	value, err = stub.GetState(id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if legacy_type(id, value) != object_type {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// Entity exists - whether a document is stored for an entity, whether it can be decoded or not
+func entity_exists(stub shim.ChaincodeStubInterface, object_type string, id string) (bool, error) {
+	value, err := get_entity(stub, object_type, id)
+	return value != nil, err
+}
+
+// Put entity - store an entity in its namespace, and remove the simple key it was stored under before namespaces
+func put_entity(stub shim.ChaincodeStubInterface, object_type string, id string, value []byte) error {
+	key, err := entity_key(stub, object_type, id)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, value)
+	if err != nil {
+		return err
+	}
+
+	legacy, err := stub.GetState(id)
+	if err != nil {
+		return err
+	}
+	if legacy != nil && legacy_type(id, legacy) == object_type {
+		// a stock rewritten before migrate_state reached it still needs its code indexed
+		if object_type == stock_namespace {
+			err = index_legacy_stock(stub, legacy)
+			if err != nil {
+				return err
+			}
+		}
+		return stub.DelState(id)
+	}
+	return nil
+}
+
+// Scan entities - visit every entity of a type: those in its namespace in id order, then those still stored
+// under simple keys until migrate_state has moved them
+func scan_entities(stub shim.ChaincodeStubInterface, object_type string, visit func(id string, value []byte) error) error {
+	entityIterator, err := stub.GetStateByPartialCompositeKey(object_type, []string{})
+	if err != nil {
+		return err
+	}
+	defer entityIterator.Close()
+
+	for entityIterator.HasNext() {
+		aKeyValue, err := entityIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return err
+		}
+		err = visit(attributes[0], aKeyValue.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	legacyIterator, err := stub.GetStateByRange(min_key, max_key)
+	if err != nil {
+		return err
+	}
+	defer legacyIterator.Close()
+
+	for legacyIterator.HasNext() {
+		aKeyValue, err := legacyIterator.Next()
+		if err != nil {
+			return err
+		}
+		if is_composite_key(aKeyValue.Key) || legacy_type(aKeyValue.Key, aKeyValue.Value) != object_type {
+			continue
+		}
+		key, err := entity_key(stub, object_type, aKeyValue.Key)
+		if err != nil {
+			return err
+		}
+		shadow, err := stub.GetState(key)
+		if err != nil {
+			return err
+		}
+		if shadow != nil {
+			continue
+		}
+		err = visit(aKeyValue.Key, aKeyValue.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get stock - get a stock asset from ledger
 func get_stock(stub shim.ChaincodeStubInterface, id string) (Stock, error) {
 	var stock Stock
-	stockAsBytes, err := stub.GetState(id)                  	//getState retreives a key/value from the ledger
+	stockAsBytes, err := get_entity(stub, stock_namespace, id)         	//getState retreives a key/value from the ledger
 	if err != nil {                                          	//this seems to always succeed, even if key didn't exist
 		return stock, errors.New("Failed to find stock - " + id)
 	}
-	json.Unmarshal(stockAsBytes, &stock)                   		//un stringify it aka JSON.parse()
+	if stockAsBytes == nil {
+		return stock, errors.New("Stock does not exist - " + id)
+	}
+	stock, err = decode_stock(stockAsBytes)                   		//un stringify it aka JSON.parse()
+	if err != nil {
+		return stock, err
+	}
 
 	if stock.Id != id {                                     //test if stock is actually here or just nil
 		return stock, errors.New("Stock does not exist - " + id)
@@ -24,14 +205,42 @@ func get_stock(stub shim.ChaincodeStubInterface, id string) (Stock, error) {
 	return stock, nil
 }
 
+// Get stock id by code - the id of the stock issued under a code, empty when no stock holds it
+func get_stock_id_by_code(stub shim.ChaincodeStubInterface, code string) (string, error) {
+	codeKey, err := stub.CreateCompositeKey(stock_by_code, []string{code})
+	if err != nil {
+		return "", err
+	}
+	idAsBytes, err := stub.GetState(codeKey)
+	if err != nil {
+		return "", errors.New("Failed to find stock code - " + code)
+	}
+	return string(idAsBytes), nil
+}
+
+// Put stock code - index a stock under its code, the caller checks the code is free
+func put_stock_code(stub shim.ChaincodeStubInterface, stock Stock) error {
+	codeKey, err := stub.CreateCompositeKey(stock_by_code, []string{stock.Code})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(codeKey, []byte(stock.Id))
+}
+
 // Get User - get the user asset from ledger
 func get_user(stub shim.ChaincodeStubInterface, id string) (User, error) {
 	var user User
-	userAsBytes, err := stub.GetState(id)                     //getState retreives a key/value from the ledger
+	userAsBytes, err := get_entity(stub, user_namespace, id)            //getState retreives a key/value from the ledger
 	if err != nil {                                            //this seems to always succeed, even if key didn't exist
 		return user, errors.New("Failed to get user - " + id)
 	}
-	json.Unmarshal(userAsBytes, &user)                       //un stringify it aka JSON.parse()
+	if userAsBytes == nil {
+		return user, errors.New("User does not exist - " + id)
+	}
+	user, err = decode_user(userAsBytes)                       //un stringify it aka JSON.parse()
+	if err != nil {
+		return user, err
+	}
 
 	if len(user.Name) == 0 {                              //test if user is actually here or just nil
 		return user, errors.New("User does not exist - " + id + ", '" + user.Name)
@@ -42,11 +251,17 @@ func get_user(stub shim.ChaincodeStubInterface, id string) (User, error) {
 
 func get_transaction(stub shim.ChaincodeStubInterface, id string) (Trade, error) {
 	var tran Trade
-	tranAsBytes, err := stub.GetState(id)                     //getState retreives a key/value from the ledger
+	tranAsBytes, err := get_entity(stub, trade_namespace, id)            //getState retreives a key/value from the ledger
 	if err != nil {                                            //this seems to always succeed, even if key didn't exist
 		return tran, errors.New("Failed to get transaction - " + id)
 	}
-	json.Unmarshal(tranAsBytes, &tran)                       //un stringify it aka JSON.parse()
+	if tranAsBytes == nil {
+		return tran, errors.New("Transaction does not exist - " + id)
+	}
+	tran, err = decode_trade(tranAsBytes)                       //un stringify it aka JSON.parse()
+	if err != nil {
+		return tran, err
+	}
 	
 	if tran.Id != id {                                     //test if stock is actually here or just nil
 		return tran, errors.New("Transaction does not exist - " + id)
@@ -55,6 +270,51 @@ func get_transaction(stub shim.ChaincodeStubInterface, id string) (Trade, error)
 	return tran, nil
 }
 
+// Get trades by user - every trade where the user is buyer or seller, in time order
+func get_trades_by_user(stub shim.ChaincodeStubInterface, user_id string) ([]Trade, error) {
+	bought, err := get_indexed_trades(stub, trade_by_buyer, []string{user_id})
+	if err != nil {
+		return nil, err
+	}
+	sold, err := get_indexed_trades(stub, trade_by_seller, []string{user_id})
+	if err != nil {
+		return nil, err
+	}
+
+	trades := bought
+	for _, trade := range sold {
+		if trade.Buyer.Id != user_id {
+			trades = append(trades, trade)
+		}
+	}
+	sort.SliceStable(trades, func(i, j int) bool {
+		return index_time(trades[i].Time) < index_time(trades[j].Time)
+	})
+	return trades, nil
+}
+
+// Time layouts accepted by parse_time, besides unix seconds
+var time_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Parse time - read a timestamp given as RFC3339, "yyyy-mm-dd hh:mm:ss", "yyyy-mm-dd" or unix seconds, in UTC
+func parse_time(value string) (time.Time, error) {
+	for _, layout := range time_layouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Time{}, errors.New("Invalid time - " + value)
+}
+
 // ========================================================
 // Input Sanitation - dumb input checking, look for empty strings
 // ========================================================
@@ -69,3 +329,18 @@ func sanitize_arguments(strs []string) error{
 	}
 	return nil
 }
+
+// Contains - whether a list of strings holds a value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Is composite key - composite keys start with a null character and are skipped by scans over simple keys
+func is_composite_key(key string) bool {
+	return len(key) > 0 && key[0] == 0x00
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Lifecycle status of a stock: only an active stock trades, a suspended stock may be resumed,
+// a halted stock was stopped by the circuit breaker (see band.go), a delisted stock stays delisted
+const (
+	stock_active    = "active"
+	stock_suspended = "suspended"
+	stock_halted    = "halted"
+	stock_delisted  = "delisted"
+)
+
+var stock_statuses = []string{stock_active, stock_suspended, stock_halted, stock_delisted}
+
+// Status transitions allowed from each status through set_stock_status, a halted stock
+// can only be delisted there, it is resumed by an admin with resume_stock
+var status_transitions = map[string][]string{
+	stock_active:    {stock_suspended, stock_delisted},
+	stock_suspended: {stock_active, stock_delisted},
+	stock_halted:    {stock_delisted},
+	stock_delisted:  {},
+}
+
+// Check active - whether a stock may be traded or issued
+func check_active(stock Stock) error {
+	if stock.Status != stock_active {
+		return errors.New("This stock is " + stock.Status + " - " + stock.Id)
+	}
+	return nil
+}
+
+// Set stock status - suspend, resume or delist a stock. Only its creator or an admin may suspend or resume
+// a stock, delisting is reserved to an admin
+func set_stock_status(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	log_debug(stub, "starting")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stock_id := args[0]
+	status := args[1]
+	if !contains(stock_statuses, status) {
+		return shim.Error("Unknown status - " + status)
+	}
+
+	uow := new_unit_of_work(stub)
+	stock, err := get_stock(uow, stock_id)
+	if err != nil {
+		return shim.Error("This stock does not exist - " + stock_id)
+	}
+	if status == stock_delisted {
+		err = check_role(stub, role_admin)
+	} else {
+		err = check_owner(stub, stock.Creator.Id)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !contains(status_transitions[stock.Status], status) {
+		return shim.Error("This stock cannot go from " + stock.Status + " to " + status + " - " + stock_id)
+	}
+
+	previous := stock.Status
+	stock.Status = status
+	stockAsBytes, _ := json.Marshal(stock) //convert to array of bytes
+	err = put_entity(uow, stock_namespace, stock.Id, stockAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = uow.commit()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "stock status changed", "stock_id", stock.Id, "from", previous, "to", status)
+	return shim.Success(nil)
+}
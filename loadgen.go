@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ========================================================
+// Load generator - populate the simulator with synthetic users, stocks and trades, then measure
+// the latency, state reads, writes and response size of the main functions:
+//
+//	stocks loadgen [-users 100000] [-stocks 50] [-trades 1000000] [-samples 200] [-save report.json]
+//	               [-baseline report.json] [-threshold 0.2]
+//
+// With a baseline (the saved report of another version) every metric that grew by more than the
+// threshold is reported as a regression and the command exits with status 1
+// ========================================================
+
+// ----- LoadSpec ----- //
+type LoadSpec struct {
+	Users   int   `json:"users"`
+	Stocks  int   `json:"stocks"`
+	Trades  int   `json:"trades"`
+	Compact int   `json:"compact"` // gộp số dư của nhà tạo lập sau mỗi chừng ấy giao dịch, 0 là không gộp
+	Seed    int64 `json:"seed"`
+}
+
+// ----- FunctionStats ----- //
+type FunctionStats struct {
+	Name          string  `json:"name"`
+	Calls         int     `json:"calls"`
+	Failed        int     `json:"failed"`
+	MeanMicros    float64 `json:"mean_us"`
+	P50Micros     float64 `json:"p50_us"`
+	P95Micros     float64 `json:"p95_us"`
+	Reads         float64 `json:"reads"` // trung bình mỗi lần gọi
+	Queries       float64 `json:"queries"`
+	Writes        float64 `json:"writes"`
+	ResponseBytes float64 `json:"response_bytes"`
+}
+
+// ----- LoadReport ----- //
+type LoadReport struct {
+	Spec         LoadSpec        `json:"spec"`
+	PopulateSecs float64         `json:"populate_s"`
+	Keys         int             `json:"keys"`
+	Functions    []FunctionStats `json:"functions"`
+}
+
+// Synthetic ids, u<number> for users and s<number> for stocks
+func load_user(i int) string  { return "u" + strconv.Itoa(i) }
+func load_stock(i int) string { return "s" + strconv.Itoa(i) }
+
+// Load time - the time of the n-th synthetic trade, one per second from 2024-01-01
+func load_time(n int) string {
+	return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(n) * time.Second).Format(time.RFC3339)
+}
+
+// ----- LoadGen ----- //
+type LoadGen struct {
+	sim      *Simulator
+	spec     LoadSpec
+	rand     *rand.Rand
+	balances map[[2]int]int64 // số dư theo (user, stock) để chọn người bán hợp lệ
+	trades   int
+}
+
+// New load gen - a simulator populated following the spec
+func new_load_gen(spec LoadSpec) (*LoadGen, error) {
+	gen := &LoadGen{sim: new_simulator(), spec: spec, rand: rand.New(rand.NewSource(spec.Seed)),
+		balances: make(map[[2]int]int64)}
+	if spec.Users < 2 || spec.Stocks < 1 {
+		return nil, errors.New("Load needs at least 2 users and 1 stock")
+	}
+
+	// u0 issues every stock and acts as the market maker
+	type UserItem struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+	for first := 0; first < spec.Users; first += 1000 {
+		var items []UserItem
+		for i := first; i < first+1000 && i < spec.Users; i++ {
+			items = append(items, UserItem{Id: load_user(i), Name: "User " + strconv.Itoa(i)})
+		}
+		itemsAsBytes, _ := json.Marshal(items)
+		err := gen.call("bulk_init_users", string(itemsAsBytes))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	issued := int64(spec.Trades)*10 + 1000000
+	type StockItem struct {
+		Id     string `json:"id"`
+		Code   string `json:"code"`
+		Count  string `json:"count"`
+		Price  string `json:"price"`
+		UserId string `json:"user_id"`
+	}
+	var stocks []StockItem
+	for i := 0; i < spec.Stocks; i++ {
+		stocks = append(stocks, StockItem{Id: load_stock(i), Code: "FUND" + strconv.Itoa(i),
+			Count: strconv.FormatInt(issued, 10), Price: "100", UserId: load_user(0)})
+		gen.balances[[2]int{0, i}] = issued
+	}
+	stocksAsBytes, _ := json.Marshal(stocks)
+	err := gen.call("bulk_init_stocks", string(stocksAsBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	for gen.trades < spec.Trades {
+		err = gen.trade()
+		if err != nil {
+			return nil, err
+		}
+		if spec.Compact > 0 && gen.trades%spec.Compact == 0 {
+			err = gen.call("compact_balance", load_user(0))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if gen.trades%(spec.Trades/10+1) == 0 {
+			fmt.Fprintln(os.Stderr, "populated "+strconv.Itoa(gen.trades)+" trades")
+		}
+	}
+	return gen, nil
+}
+
+// Call - run a call during population, it must succeed
+func (gen *LoadGen) call(function string, args ...string) error {
+	result := gen.sim.run(ScriptCall{Function: function, Args: args, Timestamp: load_time(gen.trades)}, role_admin, "Org1MSP")
+	if result.Status != shim.OK {
+		return errors.New(function + " failed - " + result.Message)
+	}
+	return nil
+}
+
+// Next trade - the arguments of a random valid trade: half of the trades are sold by the market maker,
+// the others by a random user who holds the stock
+func (gen *LoadGen) next_trade() []string {
+	stock := gen.rand.Intn(gen.spec.Stocks)
+	seller := 0
+	if gen.rand.Intn(2) == 1 {
+		candidate := 1 + gen.rand.Intn(gen.spec.Users-1)
+		if gen.balances[[2]int{candidate, stock}] > 0 {
+			seller = candidate
+		}
+	}
+	buyer := 1 + gen.rand.Intn(gen.spec.Users-1)
+	if buyer == seller {
+		buyer = 0
+	}
+	count := int64(1 + gen.rand.Intn(10))
+	if held := gen.balances[[2]int{seller, stock}]; count > held {
+		count = held
+	}
+	gen.balances[[2]int{seller, stock}] -= count
+	gen.balances[[2]int{buyer, stock}] += count
+
+	gen.trades++
+	price := strconv.Itoa(99 + gen.rand.Intn(3)) // within the default circuit breaker
+	return []string{"t" + strconv.Itoa(gen.trades), load_stock(stock), strconv.FormatInt(count, 10),
+		load_user(seller), load_user(buyer), load_time(gen.trades), price}
+}
+
+// Trade - record a random valid trade
+func (gen *LoadGen) trade() error {
+	return gen.call("init_transaction", gen.next_trade()...)
+}
+
+// Measure - run a function samples times with generated arguments and summarize the calls
+func (gen *LoadGen) measure(name string, samples int, args func() []string) FunctionStats {
+	stats := FunctionStats{Name: name}
+	var durations []float64
+	for i := 0; i < samples; i++ {
+		result := gen.sim.run(ScriptCall{Function: name, Args: args(), Timestamp: load_time(gen.trades)}, role_admin, "Org1MSP")
+		stats.Calls++
+		if result.Status != shim.OK {
+			stats.Failed++
+		}
+		micros := float64(result.Stats.Duration.Nanoseconds()) / 1000
+		durations = append(durations, micros)
+		stats.MeanMicros += micros
+		stats.Reads += float64(result.Stats.Reads)
+		stats.Queries += float64(result.Stats.Queries)
+		stats.Writes += float64(result.Stats.Writes)
+		stats.ResponseBytes += float64(len(result.Payload) + len(result.Message))
+	}
+	if stats.Calls == 0 {
+		return stats
+	}
+	calls := float64(stats.Calls)
+	stats.MeanMicros /= calls
+	stats.Reads /= calls
+	stats.Queries /= calls
+	stats.Writes /= calls
+	stats.ResponseBytes /= calls
+	sort.Float64s(durations)
+	stats.P50Micros = durations[len(durations)/2]
+	stats.P95Micros = durations[len(durations)*95/100]
+	return stats
+}
+
+// Measure all - the functions covered by the load report
+func (gen *LoadGen) measure_all(samples int) []FunctionStats {
+	random_user := func() string { return load_user(gen.rand.Intn(gen.spec.Users)) }
+	random_stock := func() string { return load_stock(gen.rand.Intn(gen.spec.Stocks)) }
+	return []FunctionStats{
+		gen.measure("init_transaction", samples, gen.next_trade),
+		gen.measure("get_list_user_have_stock_by_id", samples, func() []string { return []string{random_stock()} }),
+		gen.measure("get_portfolio", samples, func() []string { return []string{random_user(), "true"} }),
+		gen.measure("get_list_transaction_by_user", samples, func() []string { return []string{random_user()} }),
+		gen.measure("search_transactions", samples, func() []string {
+			return []string{`{"stock_id":"` + random_stock() + `","sort":"desc","page_size":50}`}
+		}),
+		gen.measure("get_candles", samples, func() []string {
+			return []string{random_stock(), "1d", load_time(0), load_time(gen.trades)}
+		}),
+		gen.measure("compact_balance", samples, func() []string { return []string{random_user()} }),
+	}
+}
+
+// Regressions - the metrics of a report that grew by more than threshold over the baseline
+func regressions(baseline LoadReport, report LoadReport, threshold float64) []string {
+	previous := make(map[string]FunctionStats)
+	for _, stats := range baseline.Functions {
+		previous[stats.Name] = stats
+	}
+
+	var found []string
+	for _, stats := range report.Functions {
+		before, ok := previous[stats.Name]
+		if !ok {
+			continue
+		}
+		metrics := []struct {
+			name   string
+			before float64
+			after  float64
+			slack  float64 // chênh lệch tuyệt đối được bỏ qua
+		}{
+			{"mean_us", before.MeanMicros, stats.MeanMicros, 50},
+			{"p95_us", before.P95Micros, stats.P95Micros, 50},
+			{"reads", before.Reads, stats.Reads, 1},
+			{"writes", before.Writes, stats.Writes, 1},
+			{"response_bytes", before.ResponseBytes, stats.ResponseBytes, 64},
+		}
+		for _, metric := range metrics {
+			if metric.after > metric.before*(1+threshold) && metric.after-metric.before > metric.slack {
+				found = append(found, stats.Name+" "+metric.name+" "+strconv.FormatFloat(metric.before, 'f', 1, 64)+
+					" -> "+strconv.FormatFloat(metric.after, 'f', 1, 64))
+			}
+		}
+	}
+	return found
+}
+
+// Print report - a table of the measured functions
+func print_report(report LoadReport) {
+	fmt.Fprintf(os.Stderr, "%d users, %d stocks, %d trades, %d keys, populated in %.1fs\n",
+		report.Spec.Users, report.Spec.Stocks, report.Spec.Trades, report.Keys, report.PopulateSecs)
+	fmt.Fprintf(os.Stderr, "%-32s %6s %10s %10s %10s %10s %8s %8s %10s\n",
+		"function", "calls", "mean_us", "p50_us", "p95_us", "reads", "queries", "writes", "bytes")
+	for _, stats := range report.Functions {
+		fmt.Fprintf(os.Stderr, "%-32s %6d %10.1f %10.1f %10.1f %10.1f %8.1f %8.1f %10.1f\n", stats.Name, stats.Calls,
+			stats.MeanMicros, stats.P50Micros, stats.P95Micros, stats.Reads, stats.Queries, stats.Writes, stats.ResponseBytes)
+	}
+}
+
+// Loadgen - the loadgen command, returns the exit code
+func loadgen(args []string) int {
+	var spec LoadSpec
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	flags.IntVar(&spec.Users, "users", 1000, "number of synthetic users")
+	flags.IntVar(&spec.Stocks, "stocks", 10, "number of synthetic stocks")
+	flags.IntVar(&spec.Trades, "trades", 10000, "number of synthetic trades")
+	flags.IntVar(&spec.Compact, "compact", 1000, "compact the market maker balance every n trades, 0 never")
+	flags.Int64Var(&spec.Seed, "seed", 1, "random seed")
+	samples := flags.Int("samples", 200, "calls measured per function")
+	save := flags.String("save", "", "file to write the report to")
+	baseline := flags.String("baseline", "", "report of a previous version to compare with")
+	threshold := flags.Float64("threshold", 0.2, "relative growth of a metric reported as a regression")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	// chaincode logs would dominate the measure, they are discarded
+	log_output = ioutil.Discard
+	defer func() { log_output = nil }()
+
+	var report LoadReport
+	report.Spec = spec
+	start := time.Now()
+	gen, err := new_load_gen(spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report.PopulateSecs = time.Since(start).Seconds()
+	report.Keys = len(gen.sim.state.keys)
+	report.Functions = gen.measure_all(*samples)
+	print_report(report)
+
+	reportAsBytes, _ := json.MarshalIndent(report, "", "  ")
+	if len(*save) > 0 {
+		err = ioutil.WriteFile(*save, append(reportAsBytes, '\n'), 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		fmt.Println(string(reportAsBytes))
+	}
+
+	if len(*baseline) > 0 {
+		baselineAsBytes, err := ioutil.ReadFile(*baseline)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var previous LoadReport
+		err = json.Unmarshal(baselineAsBytes, &previous)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read baseline - "+err.Error())
+			return 1
+		}
+		if previous.Spec != spec {
+			fmt.Fprintln(os.Stderr, "warning: the baseline was measured with a different load")
+		}
+		found := regressions(previous, report, *threshold)
+		for _, regression := range found {
+			fmt.Fprintln(os.Stderr, "REGRESSION "+regression)
+		}
+		if len(found) > 0 {
+			return 1
+		}
+	}
+	return 0
+}
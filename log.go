@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Log levels, a line is written when its level is at least log_level
+const (
+	level_debug = iota
+	level_info
+	level_warning
+	level_error
+)
+
+var level_names = []string{"debug", "info", "warning", "error"}
+
+// Logging configuration, read from the environment at chaincode start by configure_logging
+var (
+	log_level  = level_info
+	log_redact = true    // thay thông tin cá nhân bằng mã băm
+	log_output io.Writer // nil là os.Stdout
+)
+
+// Fields holding personal data, their values are replaced by a short hash so lines can still be correlated
+var personal_fields = []string{"name", "seller_name", "buyer_name"}
+
+// Configure logging - STOCKS_LOG_LEVEL sets the level (debug, info, warning, error),
+// STOCKS_LOG_REDACT=false keeps personal fields in clear
+func configure_logging() {
+	level := strings.ToLower(os.Getenv("STOCKS_LOG_LEVEL"))
+	for i, name := range level_names {
+		if level == name {
+			log_level = i
+		}
+	}
+	if os.Getenv("STOCKS_LOG_REDACT") == "false" {
+		log_redact = false
+	}
+}
+
+func log_debug(stub shim.ChaincodeStubInterface, msg string, fields ...interface{}) {
+	write_log(stub, level_debug, msg, fields)
+}
+
+func log_info(stub shim.ChaincodeStubInterface, msg string, fields ...interface{}) {
+	write_log(stub, level_info, msg, fields)
+}
+
+func log_warning(stub shim.ChaincodeStubInterface, msg string, fields ...interface{}) {
+	write_log(stub, level_warning, msg, fields)
+}
+
+func log_error(stub shim.ChaincodeStubInterface, msg string, fields ...interface{}) {
+	write_log(stub, level_error, msg, fields)
+}
+
+// Write log - one line of key=value pairs: time, level, tx id and function of the call, message, then the fields
+// given as alternating keys and values
+func write_log(stub shim.ChaincodeStubInterface, level int, msg string, fields []interface{}) {
+	if level < log_level {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString("time=" + time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(" level=" + level_names[level])
+	if stub != nil {
+		function, _ := stub.GetFunctionAndParameters()
+		line.WriteString(" tx=" + log_value(stub.GetTxID()))
+		line.WriteString(" fn=" + log_value(function))
+	}
+	line.WriteString(" msg=" + log_value(msg))
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		value := "(missing)"
+		if i+1 < len(fields) {
+			value = fmt.Sprint(fields[i+1])
+		}
+		if log_redact && contains(personal_fields, key) {
+			value = redact(value)
+		}
+		line.WriteString(" " + key + "=" + log_value(value))
+	}
+	line.WriteString("\n")
+
+	output := log_output
+	if output == nil {
+		output = os.Stdout
+	}
+	io.WriteString(output, line.String())
+}
+
+// Log value - quote a value holding spaces, quotes or '=' so the line stays parseable
+func log_value(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// Redact - the short hash standing for a personal value
+func redact(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Private data collection holding confidential trade terms, see collections_config.json
+const trade_terms_collection = "collectionTradeTerms"
+
+// Transient map key carrying the confidential terms of init_transaction
+const trade_terms_transient = "trade_terms"
+
+// ----- TradeTerms ----- //
+type TradeTerms struct {
+	ObjectType string   `json:"docType"` // field for couchdb
+	Id         string   `json:"id"`      // id giao dịch
+	Price      Amount   `json:"price"`   // giá khớp lệnh
+	SellerName string   `json:"seller_name"`
+	BuyerName  string   `json:"buyer_name"`
+	Orgs       []string `json:"orgs"` // các tổ chức được đọc điều khoản
+	Salt       string   `json:"salt"` // chuỗi ngẫu nhiên, hex, để mã băm không bị dò ngược
+}
+
+// Minimum length of the salt of the terms, in hex digits
+const min_salt_length = 32
+
+// Get caller msp - the MSP id of the caller's organization
+var get_caller_msp = func(stub shim.ChaincodeStubInterface) (string, error) {
+	return cid.GetMSPID(stub)
+}
+
+// Get trade terms - the confidential terms passed in the transient map, nil when the trade is public.
+// The transient value is a JSON object {"price", "orgs", "salt"} with the price at the given scale and a random
+// salt of at least 16 bytes in hex, chosen by the client since endorsers must agree on it. Names are public
+// and prices fall in a small range, without the salt the hash on the ledger would give the price away.
+// The caller's organization is always allowed to read
+func get_trade_terms(stub shim.ChaincodeStubInterface, scale int) (*TradeTerms, error) {
+	type Transient struct {
+		Price json.Number `json:"price"`
+		Orgs  []string    `json:"orgs"`
+		Salt  string      `json:"salt"`
+	}
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	termsAsBytes, found := transient[trade_terms_transient]
+	if !found {
+		return nil, nil
+	}
+
+	var transientTerms Transient
+	err = json.Unmarshal(termsAsBytes, &transientTerms)
+	if err != nil {
+		return nil, errors.New("Transient '" + trade_terms_transient + "' must be a JSON object {price, orgs} - " + err.Error())
+	}
+	var terms TradeTerms
+	terms.Price, err = parse_amount(transientTerms.Price.String(), scale)
+	if err != nil || terms.Price <= 0 {
+		return nil, errors.New("Transient '" + trade_terms_transient + "' must carry a positive price")
+	}
+	terms.Orgs = transientTerms.Orgs
+	_, err = hex.DecodeString(transientTerms.Salt)
+	if err != nil || len(transientTerms.Salt) < min_salt_length {
+		return nil, errors.New("Transient '" + trade_terms_transient + "' must carry a random salt of at least " +
+			strconv.Itoa(min_salt_length) + " hex digits")
+	}
+	terms.Salt = transientTerms.Salt
+
+	msp, err := get_caller_msp(stub)
+	if err != nil {
+		return nil, errors.New("Failed to get caller organization - " + err.Error())
+	}
+	if !contains(terms.Orgs, msp) {
+		terms.Orgs = append(terms.Orgs, msp)
+	}
+	terms.ObjectType = "trade_terms"
+	return &terms, nil
+}
+
+// Put trade terms - store the terms in the private collection, returns the hash kept on the channel ledger
+func put_trade_terms(stub shim.ChaincodeStubInterface, terms TradeTerms) (string, error) {
+	termsAsBytes, _ := json.Marshal(terms)
+	err := stub.PutPrivateData(trade_terms_collection, terms.Id, termsAsBytes)
+	if err != nil {
+		return "", err
+	}
+	return hash_terms(termsAsBytes), nil
+}
+
+// Hash terms - hex sha256 of the stored terms, salt included
+func hash_terms(termsAsBytes []byte) string {
+	sum := sha256.Sum256(termsAsBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get private trade - a trade together with its confidential terms, for the organizations named in the terms
+func get_private_trade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type PrivateTrade struct {
+		Trade Trade      `json:"transaction"`
+		Terms TradeTerms `json:"terms"`
+	}
+
+	trade_id := args[0]
+	trade, err := get_transaction(stub, trade_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(trade.TermsHash) == 0 {
+		return shim.Error("This transaction has no private terms - " + trade_id)
+	}
+
+	termsAsBytes, err := stub.GetPrivateData(trade_terms_collection, trade_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if termsAsBytes == nil {
+		return shim.Error("Private terms are not available on this peer - " + trade_id)
+	}
+	if hash_terms(termsAsBytes) != trade.TermsHash {
+		return shim.Error("Private terms do not match the hash on the ledger - " + trade_id)
+	}
+
+	var private PrivateTrade
+	err = json.Unmarshal(termsAsBytes, &private.Terms)
+	if err != nil {
+		return shim.Error("Failed to decode private terms - " + err.Error())
+	}
+
+	msp, err := get_caller_msp(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller organization - " + err.Error())
+	}
+	if !contains(private.Terms.Orgs, msp) {
+		log_warning(stub, "private terms denied", "trade_id", trade_id, "msp", msp)
+		return shim.Error("This organization may not read the private terms - " + msp)
+	}
+
+	private.Trade = trade
+	private.Trade.Price = private.Terms.Price
+	private.Trade.Seller.Name = private.Terms.SellerName
+	private.Trade.Buyer.Name = private.Terms.BuyerName
+
+	//change to array of bytes
+	privateAsBytes, _ := json.Marshal(private)
+	return shim.Success(privateAsBytes)
+}
@@ -2,108 +2,300 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
+	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // Get list stock 
-func get_list_stock(stub shim.ChaincodeStubInterface) pb.Response {
+func get_list_stock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type ListStock struct {
 		Stocks   []Stock   `json:"stocks"`
 	}
 	var listStock ListStock
 
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	var status string
+	if len(args) == 1 && len(args[0]) > 0 {
+		status = args[0]
+		if !contains(stock_statuses, status) {
+			return shim.Error("Unknown status - " + status)
+		}
+	}
+
 	// ---- Get All Stock --- //
-	resultsIterator, err := stub.GetStateByRange("s0", "s9999999999999999999")
+	err := scan_entities(stub, stock_namespace, func(id string, value []byte) error {
+		stock, err := decode_stock(value)
+		if err != nil {
+			return err
+		}
+		if len(status) > 0 && stock.Status != status {
+			return nil
+		}
+		err = with_issued(stub, &stock)
+		if err != nil {
+			return err
+		}
+		listStock.Stocks = append(listStock.Stocks, stock)
+		return nil
+	})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
-	
-	for resultsIterator.HasNext() {
-		aKeyValue, err := resultsIterator.Next()
+	log_debug(stub, "stocks", "count", len(listStock.Stocks))
+
+	//change to array of bytes
+	listStockAsBytes, _ := json.Marshal(listStock)              	
+	return shim.Success(listStockAsBytes)
+}
+
+// Get stock by code - the stock issued under a code
+func get_stock_by_code(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	code := args[0]
+	stock_id, err := get_stock_id_by_code(stub, code)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(stock_id) == 0 {
+		return shim.Error("Stock code does not exist - " + code)
+	}
+	stock, err := get_stock(stub, stock_id)
+	if err == nil {
+		err = with_issued(stub, &stock)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//change to array of bytes
+	stockAsBytes, _ := json.Marshal(stock)
+	return shim.Success(stockAsBytes)
+}
+
+func get_list_user(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ListUser struct {
+		Users   []User   `json:"users"`
+	}
+	var listUser ListUser
+
+	// ---- Get All user --- //
+	err := scan_entities(stub, user_namespace, func(id string, value []byte) error {
+		user, err := decode_user(value)
 		if err != nil {
-			return shim.Error(err.Error())
+			return err
+		}
+		listUser.Users = append(listUser.Users, user)
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	log_debug(stub, "users", "count", len(listUser.Users))
+
+	//change to array of bytes
+	listUserAsBytes, _ := json.Marshal(listUser)              	
+	return shim.Success(listUserAsBytes)
+}
+
+func get_list_transaction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ListTrade struct {
+		Trans   []Trade   `json:"transactions"`
+	}
+	var listTran ListTrade
+
+	// ---- Get All Transaction --- //
+	err := scan_entities(stub, trade_namespace, func(id string, value []byte) error {
+		transaction, err := decode_trade(value)
+		if err != nil {
+			return err
 		}
-		queryKeyAsStr := aKeyValue.Key
-		queryValAsBytes := aKeyValue.Value
-		fmt.Println("on stock id - ", queryKeyAsStr)
-		var stock Stock
-		json.Unmarshal(queryValAsBytes, &stock)                  	
-		fmt.Println(stock)
-		listStock.Stocks = append(listStock.Stocks, stock)   		
+		listTran.Trans = append(listTran.Trans, transaction)
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	log_debug(stub, "transactions", "count", len(listTran.Trans))
+
+	//change to array of bytes
+	listTranAsBytes, _ := json.Marshal(listTran)              	
+	return shim.Success(listTranAsBytes)
+}
 
+// Read stock - a single stock by id
+func read_stock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	stock, err := get_stock(stub, args[0])
+	if err == nil {
+		err = with_issued(stub, &stock)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	fmt.Println("stock array - ", listStock.Stocks)
 
 	//change to array of bytes
-	listStockAsBytes, _ := json.Marshal(listStock)              	
+	stockAsBytes, _ := json.Marshal(stock)
+	return shim.Success(stockAsBytes)
+}
+
+// Read user - a single user by id, without its positions (see get_portfolio)
+func read_user(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	user, err := get_user(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//change to array of bytes
+	userAsBytes, _ := json.Marshal(user)
+	return shim.Success(userAsBytes)
+}
+
+// Read transaction - a single trade by id
+func read_transaction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	transaction, err := get_transaction(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//change to array of bytes
+	transactionAsBytes, _ := json.Marshal(transaction)
+	return shim.Success(transactionAsBytes)
+}
+
+// Read ids - the JSON array of ids of a multi-get, at most max_page_size
+func read_ids(args []string) ([]string, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	var ids []string
+	err := json.Unmarshal([]byte(args[0]), &ids)
+	if err != nil {
+		return nil, errors.New("1st argument must be a JSON array of ids - " + err.Error())
+	}
+	if len(ids) > max_page_size {
+		return nil, errors.New("At most " + strconv.Itoa(max_page_size) + " ids can be read at once")
+	}
+	return ids, nil
+}
+
+// Read stocks - the stocks of a list of ids, in the order given, and the ids of no stock
+func read_stocks(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type ListStock struct {
+		Stocks   []Stock  `json:"stocks"`
+		NotFound []string `json:"not_found"` // các mã không tồn tại
+	}
+	var listStock ListStock
+
+	ids, err := read_ids(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, id := range ids {
+		stockAsBytes, err := get_entity(stub, stock_namespace, id)
+		if err != nil {
+			return shim.Error("Failed to find stock - " + id)
+		}
+		if stockAsBytes == nil {
+			listStock.NotFound = append(listStock.NotFound, id)
+			continue
+		}
+		stock, err := decode_stock(stockAsBytes)
+		if err == nil {
+			err = with_issued(stub, &stock)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		listStock.Stocks = append(listStock.Stocks, stock)
+	}
+
+	//change to array of bytes
+	listStockAsBytes, _ := json.Marshal(listStock)
 	return shim.Success(listStockAsBytes)
 }
 
-func get_list_user(stub shim.ChaincodeStubInterface) pb.Response {
+// Read users - the users of a list of ids, in the order given, and the ids of no user
+func read_users(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type ListUser struct {
-		Users   []User   `json:"users"`
+		Users    []User   `json:"users"`
+		NotFound []string `json:"not_found"` // các mã không tồn tại
 	}
 	var listUser ListUser
 
-	// ---- Get All user --- //
-	usersIterator, err := stub.GetStateByRange("u0", "u9999999999999999999")
+	ids, err := read_ids(args)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer usersIterator.Close()
-	
-	for usersIterator.HasNext() {
-		aKeyValue, err := usersIterator.Next()
+	for _, id := range ids {
+		userAsBytes, err := get_entity(stub, user_namespace, id)
+		if err != nil {
+			return shim.Error("Failed to get user - " + id)
+		}
+		if userAsBytes == nil {
+			listUser.NotFound = append(listUser.NotFound, id)
+			continue
+		}
+		user, err := decode_user(userAsBytes)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		queryKeyAsStr := aKeyValue.Key
-		queryValAsBytes := aKeyValue.Value
-		fmt.Println("on user id - ", queryKeyAsStr)
-		var user User
-		json.Unmarshal(queryValAsBytes, &user)                  	
-		listUser.Users = append(listUser.Users, user)   		
+		listUser.Users = append(listUser.Users, user)
 	}
-	fmt.Println("user array - ", listUser.Users)
 
 	//change to array of bytes
-	listUserAsBytes, _ := json.Marshal(listUser)              	
+	listUserAsBytes, _ := json.Marshal(listUser)
 	return shim.Success(listUserAsBytes)
 }
 
-func get_list_transaction(stub shim.ChaincodeStubInterface) pb.Response {
+// Read transactions - the trades of a list of ids, in the order given, and the ids of no trade
+func read_transactions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type ListTrade struct {
-		Trans   []Trade   `json:"transactions"`
+		Trans    []Trade  `json:"transactions"`
+		NotFound []string `json:"not_found"` // các mã không tồn tại
 	}
 	var listTran ListTrade
 
-	// ---- Get All user --- //
-	tranIterator, err := stub.GetStateByRange("t0", "t9999999999999999999")
+	ids, err := read_ids(args)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer tranIterator.Close()
-	
-	for tranIterator.HasNext() {
-		aKeyValue, err := tranIterator.Next()
+	for _, id := range ids {
+		tranAsBytes, err := get_entity(stub, trade_namespace, id)
+		if err != nil {
+			return shim.Error("Failed to get transaction - " + id)
+		}
+		if tranAsBytes == nil {
+			listTran.NotFound = append(listTran.NotFound, id)
+			continue
+		}
+		transaction, err := decode_trade(tranAsBytes)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		queryKeyAsStr := aKeyValue.Key
-		queryValAsBytes := aKeyValue.Value
-		fmt.Println("on transaction id - ", queryKeyAsStr)
-		var transaction Trade
-		json.Unmarshal(queryValAsBytes, &transaction)                  	
-		listTran.Trans = append(listTran.Trans, transaction)   		
+		listTran.Trans = append(listTran.Trans, transaction)
 	}
-	fmt.Println("transaction array - ", listTran.Trans)
 
 	//change to array of bytes
-	listTranAsBytes, _ := json.Marshal(listTran)              	
+	listTranAsBytes, _ := json.Marshal(listTran)
 	return shim.Success(listTranAsBytes)
 }
 
@@ -124,38 +316,25 @@ func get_list_transaction_by_user(stub shim.ChaincodeStubInterface, args []strin
 	}
 
 	var listTran ListTrade
-
-	// ---- Get All transaction --- //
-	tranIterator, err := stub.GetStateByRange("t0", "t9999999999999999999")
+	listTran.Trans, err = get_trades_by_user(stub, user_id)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer tranIterator.Close()
-	
-	for tranIterator.HasNext() {
-		aKeyValue, err := tranIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		queryValAsBytes := aKeyValue.Value
-		var transaction Trade
-		json.Unmarshal(queryValAsBytes, &transaction)
-		if (transaction.Buyer.Id == user_id || transaction.Seller.Id == user_id) {         	
-			listTran.Trans = append(listTran.Trans, transaction)   
-		}	
-	}
-	fmt.Println("transaction array of user-id " + user_id, listTran.Trans)
+	log_debug(stub, "transactions", "user_id", user_id, "count", len(listTran.Trans))
 
 	//change to array of bytes
 	listTranAsBytes, _ := json.Marshal(listTran)              	
 	return shim.Success(listTranAsBytes)
 }
 
+// Get list user have stock by id - the current holders of a stock, from the holder index. A user stored before
+// holding keys existed is listed once the migration, or a balance change of the user, moved the wallet out of
+// the user document
 func get_list_user_have_stock_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type UserHaveStock struct {
 		Id         	string 			`json:"id"`		
 		Name   		string 			`json:"name"`
-		Count 		int 			`json:"count"`
+		Count 		Amount 			`json:"count"`
 	}
 
 	type ListUser struct {
@@ -175,34 +354,208 @@ func get_list_user_have_stock_by_id(stub shim.ChaincodeStubInterface, args []str
 
 	var listUser ListUser
 
-	// ---- Get All transaction --- //
-	userIterator, err := stub.GetStateByRange("u0", "u9999999999999999999")
+	// ---- Get All holder --- //
+	holderIterator, err := stub.GetStateByPartialCompositeKey(holder_by_stock, []string{stock_id})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer userIterator.Close()
+	defer holderIterator.Close()
 	
-	for userIterator.HasNext() {
-		aKeyValue, err := userIterator.Next()
+	for holderIterator.HasNext() {
+		aKeyValue, err := holderIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		queryValAsBytes := aKeyValue.Value
-		var user User
 		var userHaveStock UserHaveStock
-		json.Unmarshal(queryValAsBytes, &user)
-		for _, asset := range user.Wallet {
-			if(asset.Id == stock_id) {
-				userHaveStock.Id = user.Id
-				userHaveStock.Name = user.Name
-				userHaveStock.Count = asset.Count
-				listUser.Users = append(listUser.Users, userHaveStock)  
-			}
+		user, err := get_user(stub, attributes[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		asset, err := get_holding(stub, user, stock_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if asset.Count > 0 {
+			userHaveStock.Id = user.Id
+			userHaveStock.Name = user.Name
+			userHaveStock.Count = asset.Count
+			listUser.Users = append(listUser.Users, userHaveStock)  
 		}
 	}
-	fmt.Println("list users have stock_id " + stock_id, listUser.Users)
+
+	log_debug(stub, "holders", "stock_id", stock_id, "count", len(listUser.Users))
 
 	//change to array of bytes
 	listTranAsBytes, _ := json.Marshal(listUser)              	
 	return shim.Success(listTranAsBytes)
-}
\ No newline at end of file
+}
+
+// Get portfolio - value every position of a user at the current price of its stock.
+// When include_cost is "true", cost basis (average cost over the user's priced trades) and unrealized gain
+// are added to the positions whose whole count can be traced to priced trades.
+// Count is at the unit scale of the stock, money amounts of a position are rounded half up to its price scale
+// and the total is at value_scale
+func get_portfolio(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Position struct {
+		Id             string  `json:"id"`
+		Code           string  `json:"code"`
+		Count          Amount  `json:"count"`
+		UnitScale      int     `json:"unit_scale"`
+		Price          Amount  `json:"price"`
+		PriceScale     int     `json:"price_scale"`
+		Value          Amount  `json:"value"`
+		CostBasis      *Amount `json:"cost_basis,omitempty"`
+		UnrealizedGain *Amount `json:"unrealized_gain,omitempty"`
+	}
+
+	type Portfolio struct {
+		UserId     string     `json:"user_id"`
+		Positions  []Position `json:"positions"`
+		TotalValue Amount     `json:"total_value"`
+		ValueScale int        `json:"value_scale"` // số chữ số thập phân của total_value
+	}
+
+	user_id := args[0]
+	include_cost := len(args) > 1 && args[1] == "true"
+
+	user, err := get_user(stub, user_id)
+	if err != nil {
+		return shim.Error("This user does not exist - " + user_id)
+	}
+
+	var costs map[string]PositionCost
+	if include_cost {
+		trades, err := get_trades_by_user(stub, user_id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		costs, err = average_costs(user_id, trades)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	wallet, err := get_wallet(stub, user)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var portfolio Portfolio
+	portfolio.UserId = user.Id
+	for _, asset := range wallet {
+		stock, err := get_stock(stub, asset.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var position Position
+		position.Id = asset.Id
+		position.Code = asset.Code
+		position.Count = asset.Count
+		position.UnitScale = stock.UnitScale
+		position.Price = stock.Price
+		position.PriceScale = stock.PriceScale
+
+		// count * price is at unit_scale + price_scale
+		value, err := mul_amount(asset.Count, stock.Price)
+		if err == nil {
+			position.Value, err = rescale_amount(value, stock.UnitScale+stock.PriceScale, stock.PriceScale, round_half_up)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		cost, found := costs[asset.Id]
+		if found && cost.Known && cost.Count == asset.Count {
+			gain, err := sub_amount(value, cost.Cost)
+			if err == nil {
+				gain, err = rescale_amount(gain, stock.UnitScale+stock.PriceScale, stock.PriceScale, round_half_up)
+			}
+			cost_basis, err2 := rescale_amount(cost.Cost, stock.UnitScale+stock.PriceScale, stock.PriceScale, round_half_up)
+			if err == nil {
+				err = err2
+			}
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			position.CostBasis = &cost_basis
+			position.UnrealizedGain = &gain
+		}
+
+		portfolio.Positions = append(portfolio.Positions, position)
+		if position.PriceScale > portfolio.ValueScale {
+			portfolio.ValueScale = position.PriceScale
+		}
+	}
+
+	// stocks may use different price scales, the total uses the finest one
+	for _, position := range portfolio.Positions {
+		value, err := rescale_amount(position.Value, position.PriceScale, portfolio.ValueScale, round_down)
+		if err == nil {
+			portfolio.TotalValue, err = add_amount(portfolio.TotalValue, value)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	log_debug(stub, "portfolio", "user_id", user_id, "positions", len(portfolio.Positions))
+
+	//change to array of bytes
+	portfolioAsBytes, _ := json.Marshal(portfolio)
+	return shim.Success(portfolioAsBytes)
+}
+
+// ----- PositionCost ----- //
+type PositionCost struct {
+	Count Amount // số lượng suy ra từ giao dịch
+	Cost  Amount // tổng giá vốn, theo unit_scale + price_scale
+	Known bool   // false nếu có giao dịch không có giá
+}
+
+// Average costs - replay the user's trades (in time order), buys add to the cost and sells remove it pro rata
+func average_costs(user_id string, trades []Trade) (map[string]PositionCost, error) {
+	costs := make(map[string]PositionCost)
+	for _, trade := range trades {
+		cost, found := costs[trade.Stock.Id]
+		if !found {
+			cost.Known = true
+		}
+		if trade.Buyer.Id == user_id {
+			if trade.Price <= 0 {
+				cost.Known = false
+			}
+			value, err := mul_amount(trade.Stock.Count, trade.Price)
+			if err == nil {
+				cost.Cost, err = add_amount(cost.Cost, value)
+			}
+			if err == nil {
+				cost.Count, err = add_amount(cost.Count, trade.Stock.Count)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if trade.Seller.Id == user_id {
+			var err error
+			if cost.Count > 0 {
+				var sold Amount
+				sold, err = mul_div_amount(cost.Cost, trade.Stock.Count, cost.Count)
+				if err == nil {
+					cost.Cost, err = sub_amount(cost.Cost, sold)
+				}
+			}
+			if err == nil {
+				cost.Count, err = sub_amount(cost.Count, trade.Stock.Count)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		costs[trade.Stock.Id] = cost
+	}
+	return costs, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStockCodeIsUniqueAndLooksUpItsStock(t *testing.T) {
+	sim := band_sim(t)
+	message := band_call(t, sim, role_admin, false, "init_stock", "2024-01-01T00:00:03Z", "s2", "ABC", "10", "5", "u2")
+	if !strings.Contains(message, "already used by s1") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+	band_call(t, sim, role_admin, true, "init_stock", "2024-01-01T00:00:04Z", "s2", "abc", "10", "5", "u2")
+	band_call(t, sim, role_admin, true, "subscribe", "2024-01-01T00:00:05Z", "s1", "u2", "500")
+
+	var stock Stock
+	err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "get_stock_by_code", "2024-01-01T00:00:06Z", "ABC")), &stock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stock.Id != "s1" || stock.Count != 1005 {
+		t.Fatalf("unexpected stock - %+v", stock)
+	}
+	message = band_call(t, sim, role_admin, false, "get_stock_by_code", "2024-01-01T00:00:06Z", "XYZ")
+	if !strings.Contains(message, "does not exist") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+}
+
+func TestMigratedStocksSharingACodeKeepTheFirst(t *testing.T) {
+	sim := band_sim(t)
+	for _, id := range []string{"s7", "s8"} {
+		sim.state.put(id, []byte(`{"docType":"stock","version":3,"id":"`+id+`","code":"DUP","count":10,"price":5}`))
+	}
+	band_call(t, sim, role_admin, true, "migrate_state", "2024-01-01T00:00:03Z", "10")
+
+	var stock Stock
+	json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "get_stock_by_code", "2024-01-01T00:00:04Z", "DUP")), &stock)
+	if stock.Id != "s7" {
+		t.Fatalf("code held by %s", stock.Id)
+	}
+	report := audit(t, sim, "2024-01-01T00:00:05Z")
+	for _, issue := range report.Issues {
+		if issue.Type == "duplicate_code" && issue.Key == "s8" {
+			return
+		}
+	}
+	t.Fatalf("duplicate code not reported - %+v", report.Issues)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Role attribute carried in the caller's certificate
+const role_attribute = "role"
+
+// Admin role is allowed to call every function
+const role_admin = "admin"
+
+// User attribute carried in the caller's certificate, the id of the user the caller acts for
+const user_attribute = "user_id"
+
+// ----- Function ----- //
+type Function struct {
+	Name        string                                                  `json:"name"`
+	Description string                                                  `json:"description"`
+	Args        []Argument                                              `json:"args"`
+	ReadOnly    bool                                                    `json:"read_only"`      // không ghi vào ledger
+	Role        string                                                  `json:"role,omitempty"` // vai trò yêu cầu, rỗng nếu ai cũng gọi được
+	Handler     func(shim.ChaincodeStubInterface, []string) pb.Response `json:"-"`
+}
+
+// ----- Argument ----- //
+type Argument struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // string, int, decimal, bool, json
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// Registry of every function reachable through Invoke, in the order they are documented
+var functions []Function
+
+func init() {
+	functions = []Function{
+		{
+			Name:        "init",
+			Description: "Initialize the chaincode state",
+			Args:        []Argument{},
+			Handler: func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+				return new(SimpleChaincode).Init(stub)
+			},
+		},
+		{
+			Name:        "describe_api",
+			Description: "List every function with its arguments, access mode and required role, and the wire format of the amounts",
+			Args:        []Argument{},
+			ReadOnly:    true,
+			Handler:     describe_api,
+		},
+		{
+			Name:        "init_stock",
+			Description: "Create a stock and credit the whole issue to its creator; it trades within the default 7% price band and halts on a 5% move until set_price_band changes them",
+			Args: []Argument{
+				{Name: "id", Type: "string"},
+				{Name: "code", Type: "string"},
+				{Name: "count", Type: "decimal"},
+				{Name: "price", Type: "decimal"},
+				{Name: "user_id", Type: "string"},
+				{Name: "price_scale", Type: "int", Optional: true},
+				{Name: "unit_scale", Type: "int", Optional: true},
+				{Name: "min_lot", Type: "decimal", Optional: true},
+			},
+			Handler: init_stock,
+		},
+		{
+			Name:        "update_price",
+			Description: "Set the price of a stock as its creator, positive and within its daily price band; a move past the circuit breaker threshold halts the stock",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "price", Type: "decimal"},
+			},
+			Role:    role_issuer,
+			Handler: update_price,
+		},
+		{
+			Name:        "set_stock_status",
+			Description: "Suspend or resume a stock as its creator, or delist it as an admin; only active stocks trade and a delisted stock cannot come back",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "status", Type: "string"},
+			},
+			Role:    role_issuer,
+			Handler: set_stock_status,
+		},
+		{
+			Name:        "set_price_band",
+			Description: "Set the daily price band and the circuit breaker threshold of a stock in basis points of the reference price (0 disables), optionally with the reference price of the day",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "band_bps", Type: "int"},
+				{Name: "halt_bps", Type: "int"},
+				{Name: "ref_price", Type: "decimal", Optional: true},
+			},
+			Role:    role_admin,
+			Handler: set_price_band,
+		},
+		{
+			Name:        "resume_stock",
+			Description: "Resume trading of a stock halted by the circuit breaker, centering its band on the current price",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+			},
+			Role:    role_admin,
+			Handler: resume_stock,
+		},
+		{
+			Name:        "subscribe",
+			Description: "Issue new units of a fund to a user for an invested amount at the current price, rounded down to the unit scale",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "user_id", Type: "string"},
+				{Name: "amount", Type: "decimal"},
+			},
+			Role:    role_issuer,
+			Handler: subscribe,
+		},
+		{
+			Name:        "redeem",
+			Description: "Cancel units of a fund held by a user at the current price, units may be 'all'; a remainder below the minimum lot is redeemed too. Only active funds, or delisted funds being wound down, redeem",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "user_id", Type: "string"},
+				{Name: "units", Type: "decimal"},
+			},
+			Role:    role_issuer,
+			Handler: redeem,
+		},
+		{
+			Name:        "get_list_stock",
+			Description: "List every stock, or the stocks of one status (active, suspended, halted, delisted)",
+			Args: []Argument{
+				{Name: "status", Type: "string", Optional: true},
+			},
+			ReadOnly: true,
+			Handler:  get_list_stock,
+		},
+		{
+			Name:        "get_stock_by_code",
+			Description: "Get the stock issued under a code",
+			Args: []Argument{
+				{Name: "code", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_stock_by_code,
+		},
+		{
+			Name:        "init_user",
+			Description: "Create a user with an empty wallet",
+			Args: []Argument{
+				{Name: "id", Type: "string"},
+				{Name: "name", Type: "string"},
+			},
+			Handler: init_user,
+		},
+		{
+			Name:        "init_transaction",
+			Description: "Transfer stock from seller to buyer and record the trade; confidential terms {price, orgs, salt} go in transient 'trade_terms' instead of price, salt being at least 16 random bytes in hex",
+			Args: []Argument{
+				{Name: "trade_id", Type: "string"},
+				{Name: "stock_id", Type: "string"},
+				{Name: "count", Type: "decimal"},
+				{Name: "seller_id", Type: "string"},
+				{Name: "buyer_id", Type: "string"},
+				{Name: "time", Type: "string"},
+				{Name: "price", Type: "decimal", Optional: true},
+			},
+			Handler: init_transaction,
+		},
+		{
+			Name:        "get_list_user",
+			Description: "List every user; positions are returned by get_portfolio, only users not migrated yet still carry an embedded wallet",
+			Args:        []Argument{},
+			ReadOnly:    true,
+			Handler:     get_list_user,
+		},
+		{
+			Name:        "get_list_transaction",
+			Description: "List every trade",
+			Args:        []Argument{},
+			ReadOnly:    true,
+			Handler:     get_list_transaction,
+		},
+		{
+			Name:        "read_stock",
+			Description: "Get a stock by id",
+			Args: []Argument{
+				{Name: "id", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  read_stock,
+		},
+		{
+			Name:        "read_stocks",
+			Description: "Get the stocks of a JSON array of ids, in the order given; the ids of no stock are listed under not_found",
+			Args: []Argument{
+				{Name: "ids", Type: "json"},
+			},
+			ReadOnly: true,
+			Handler:  read_stocks,
+		},
+		{
+			Name:        "read_user",
+			Description: "Get a user by id; positions are returned by get_portfolio",
+			Args: []Argument{
+				{Name: "id", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  read_user,
+		},
+		{
+			Name:        "read_users",
+			Description: "Get the users of a JSON array of ids, in the order given; the ids of no user are listed under not_found",
+			Args: []Argument{
+				{Name: "ids", Type: "json"},
+			},
+			ReadOnly: true,
+			Handler:  read_users,
+		},
+		{
+			Name:        "read_transaction",
+			Description: "Get a trade by id",
+			Args: []Argument{
+				{Name: "id", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  read_transaction,
+		},
+		{
+			Name:        "read_transactions",
+			Description: "Get the trades of a JSON array of ids, in the order given; the ids of no trade are listed under not_found",
+			Args: []Argument{
+				{Name: "ids", Type: "json"},
+			},
+			ReadOnly: true,
+			Handler:  read_transactions,
+		},
+		{
+			Name:        "get_list_transaction_by_user",
+			Description: "List the trades where the user is buyer or seller",
+			Args: []Argument{
+				{Name: "user_id", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_list_transaction_by_user,
+		},
+		{
+			Name:        "get_list_user_have_stock_by_id",
+			Description: "List the holders of a stock with the count each one holds; users whose wallet is still in their document are listed once the migration moved it",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_list_user_have_stock_by_id,
+		},
+		{
+			Name:        "get_private_trade",
+			Description: "Return a trade with its confidential terms, for the organizations named in the terms",
+			Args: []Argument{
+				{Name: "trade_id", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_private_trade,
+		},
+		{
+			Name:        "search_transactions",
+			Description: "Find trades matching a JSON filter {stock_id, buyer, seller, from, to, min_count, max_count, sort, page_size, bookmark}, every field optional",
+			Args: []Argument{
+				{Name: "filter", Type: "json"},
+			},
+			ReadOnly: true,
+			Handler:  search_transactions,
+		},
+		{
+			Name:        "get_candles",
+			Description: "Open, high, low, close and volume of a stock per interval (1d, 1w or 1M) from the priced trades between two days",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "interval", Type: "string"},
+				{Name: "from", Type: "string"},
+				{Name: "to", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_candles,
+		},
+		{
+			Name:        "get_holders_at",
+			Description: "List the holders of a stock with the count each one held at a past time (RFC3339, yyyy-mm-dd or unix seconds)",
+			Args: []Argument{
+				{Name: "stock_id", Type: "string"},
+				{Name: "time", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_holders_at,
+		},
+		{
+			Name:        "get_user_history",
+			Description: "Every balance change of a user, of one stock or of every stock, in time order with its cause, reference and the resulting balance",
+			Args: []Argument{
+				{Name: "user_id", Type: "string"},
+				{Name: "stock_id", Type: "string", Optional: true},
+			},
+			ReadOnly: true,
+			Handler:  get_user_history,
+		},
+		{
+			Name:        "get_statement",
+			Description: "Account statement of a user over [from, to): per stock the opening balance, each movement with its reference and counterparty, the closing balance, reconciled against the current wallet",
+			Args: []Argument{
+				{Name: "user_id", Type: "string"},
+				{Name: "from", Type: "string"},
+				{Name: "to", Type: "string"},
+			},
+			ReadOnly: true,
+			Handler:  get_statement,
+		},
+		{
+			Name:        "get_portfolio",
+			Description: "Value every position of a user at the current stock price, with cost basis and unrealized gain when include_cost is true",
+			Args: []Argument{
+				{Name: "user_id", Type: "string"},
+				{Name: "include_cost", Type: "bool", Optional: true},
+			},
+			ReadOnly: true,
+			Handler:  get_portfolio,
+		},
+		{
+			Name:        "compact_balance",
+			Description: "Fold the pending balance changes of a user into the holdings, of one stock or of every stock; called by the user or an admin",
+			Args: []Argument{
+				{Name: "user_id", Type: "string"},
+				{Name: "stock_id", Type: "string", Optional: true},
+			},
+			Handler: compact_balance,
+		},
+		{
+			Name:        "bulk_init_users",
+			Description: "Create every user of a JSON array of {id, name}; nothing is written if any item is invalid",
+			Args: []Argument{
+				{Name: "users", Type: "json"},
+			},
+			Handler: bulk_init_users,
+		},
+		{
+			Name:        "bulk_init_stocks",
+			Description: "Create every stock of a JSON array of {id, code, count, price, user_id, price_scale, unit_scale, min_lot}; nothing is written if any item is invalid",
+			Args: []Argument{
+				{Name: "stocks", Type: "json"},
+			},
+			Handler: bulk_init_stocks,
+		},
+		{
+			Name:        "audit_state",
+			Description: "Check every stored document and the conservation of each stock, returns a report of the issues found",
+			Args:        []Argument{},
+			ReadOnly:    true,
+			Handler:     audit_state,
+		},
+		{
+			Name:        "migrate_state",
+			Description: "Move documents under simple keys to their namespace at the current schema version, batch_size documents per call starting at cursor",
+			Args: []Argument{
+				{Name: "batch_size", Type: "int"},
+				{Name: "cursor", Type: "string", Optional: true},
+			},
+			Role:    role_admin,
+			Handler: migrate_state,
+		},
+		{
+			Name:        "list_outdated",
+			Description: "List the ids of the documents of a namespace (stock, user or trade) stored with an older schema version, page_size documents per page from the bookmark of the previous page",
+			Args: []Argument{
+				{Name: "namespace", Type: "string"},
+				{Name: "page_size", Type: "int"},
+				{Name: "bookmark", Type: "string", Optional: true},
+			},
+			ReadOnly: true,
+			Role:     role_admin,
+			Handler:  list_outdated,
+		},
+		{
+			Name:        "upgrade_entities",
+			Description: "Rewrite the documents of a namespace listed by list_outdated, a JSON array of ids, to the current schema version",
+			Args: []Argument{
+				{Name: "namespace", Type: "string"},
+				{Name: "ids", Type: "json"},
+			},
+			Role:    role_admin,
+			Handler: upgrade_entities,
+		},
+	}
+}
+
+// Find function - look up a registered function by name
+func find_function(name string) (Function, bool) {
+	for _, fn := range functions {
+		if fn.Name == name {
+			return fn, true
+		}
+	}
+	return Function{}, false
+}
+
+// Check arguments - the number of arguments must fit the function's schema
+func check_arguments(fn Function, args []string) error {
+	required := 0
+	for _, arg := range fn.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+
+	if len(args) < required || len(args) > len(fn.Args) {
+		if required == len(fn.Args) {
+			return errors.New("Incorrect number of arguments. Expecting " + strconv.Itoa(required))
+		}
+		return errors.New("Incorrect number of arguments. Expecting " + strconv.Itoa(required) + " to " + strconv.Itoa(len(fn.Args)))
+	}
+	return nil
+}
+
+// Check role - the caller's certificate must carry the role required by the function
+func check_role(stub shim.ChaincodeStubInterface, role string) error {
+	if len(role) == 0 {
+		return nil
+	}
+
+	caller, err := get_caller_role(stub)
+	if err != nil {
+		return errors.New("Failed to get caller role - " + err.Error())
+	}
+
+	if caller != role && caller != role_admin {
+		return errors.New("This function requires role '" + role + "'")
+	}
+	return nil
+}
+
+// Get caller role - read the role attribute from the caller's certificate
+var get_caller_role = func(stub shim.ChaincodeStubInterface) (string, error) {
+	role, found, err := cid.GetAttributeValue(stub, role_attribute)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errors.New("attribute '" + role_attribute + "' not found")
+	}
+	return role, nil
+}
+
+// Check owner - the caller must be an admin or act for the given user, e.g. the creator of a stock
+func check_owner(stub shim.ChaincodeStubInterface, user_id string) error {
+	role, err := get_caller_role(stub)
+	if err != nil {
+		return errors.New("Failed to get caller role - " + err.Error())
+	}
+	if role == role_admin {
+		return nil
+	}
+
+	caller, err := get_caller_user(stub)
+	if err != nil {
+		return errors.New("Failed to get caller user - " + err.Error())
+	}
+	if caller != user_id {
+		return errors.New("This call is reserved to user " + user_id + " or an admin")
+	}
+	return nil
+}
+
+// Get caller user - read the user attribute from the caller's certificate
+var get_caller_user = func(stub shim.ChaincodeStubInterface) (string, error) {
+	user_id, found, err := cid.GetAttributeValue(stub, user_attribute)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errors.New("attribute '" + user_attribute + "' not found")
+	}
+	return user_id, nil
+}
+
+// Wire format of the amounts, as told by describe_api
+const amount_format = "Decimal arguments are strings such as \"12345.67\" with at most the decimals of their scale. " +
+	"Amounts in responses are JSON integers counting the smallest unit of their scale: divide prices by 10^price_scale " +
+	"and counts, lots and units by 10^unit_scale of their stock (see read_stock), e.g. a price of 1234567 at price_scale 2 " +
+	"is 12345.67. The value of a position is at the price_scale of its stock and a total value at the value_scale given next to it"
+
+// Describe api - return the registry as JSON so clients and docs can be generated from it
+func describe_api(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Api struct {
+		Functions []Function `json:"functions"`
+		Amounts   string     `json:"amounts"` // định dạng số tiền và số lượng
+	}
+	var api Api
+	api.Functions = functions
+	api.Amounts = amount_format
+
+	apiAsBytes, _ := json.Marshal(api)
+	return shim.Success(apiAsBytes)
+}
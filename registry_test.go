@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDescribeApiListsEveryFunction(t *testing.T) {
+	sim := band_sim(t)
+	var api struct {
+		Functions []Function `json:"functions"`
+		Amounts   string     `json:"amounts"`
+	}
+	err := json.Unmarshal([]byte(band_call(t, sim, "user", true, "describe_api", "2024-01-01T00:00:03Z")), &api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.Functions) != len(functions) || len(api.Amounts) == 0 {
+		t.Fatalf("%d functions described of %d", len(api.Functions), len(functions))
+	}
+	for i, fn := range api.Functions {
+		if fn.Name != functions[i].Name || fn.Role != functions[i].Role || len(fn.Args) != len(functions[i].Args) {
+			t.Fatalf("function %s described as %+v", functions[i].Name, fn)
+		}
+	}
+}
+
+func TestInvokeChecksNameArgumentsAndRole(t *testing.T) {
+	sim := band_sim(t)
+	message := band_call(t, sim, role_admin, false, "no_such_function", "2024-01-01T00:00:03Z")
+	if !strings.Contains(message, "unknown invoke function name") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+	message = band_call(t, sim, role_admin, false, "init_user", "2024-01-01T00:00:03Z", "u3")
+	if !strings.Contains(message, "Expecting 2") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+	message = band_call(t, sim, role_admin, false, "get_list_stock", "2024-01-01T00:00:03Z", "active", "extra")
+	if !strings.Contains(message, "Expecting 0 to 1") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+
+	message = band_call(t, sim, role_issuer, false, "set_price_band", "2024-01-01T00:00:03Z", "s1", "0", "0")
+	if !strings.Contains(message, "requires role 'admin'") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+	band_call(t, sim, role_issuer, true, "update_price", "2024-01-01T00:00:04Z", "s1", "101")
+	band_call(t, sim, "user", false, "update_price", "2024-01-01T00:00:05Z", "s1", "102")
+}
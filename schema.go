@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ========================================================
+// Schema versions - step i of each list upgrades a document from version i to i+1,
+// so the current version of a document type is the length of its list. The migration stores every document
+// at the current version: migrate_state for documents under simple keys, then list_outdated and
+// upgrade_entities for the namespaces
+// ========================================================
+var stock_upgrades = []func(*Stock){
+	// 0 -> 1: written before documents carried a version
+	func(stock *Stock) {
+		stock.ObjectType = "stock"
+	},
+	// 1 -> 2: price_scale added, prices written before it are whole numbers
+	func(stock *Stock) {},
+	// 2 -> 3: unit_scale and min_lot added, counts written before them are whole units without minimum
+	func(stock *Stock) {},
+	// 3 -> 4: indexed by code under code~stock, the migration writes the index entry unless another stock holds the code
+	func(stock *Stock) {},
+	// 4 -> 5: status added, stocks written before it are active
+	func(stock *Stock) {
+		stock.Status = stock_active
+	},
+	// 5 -> 6: price band added, the reference is the current price and the default band applies
+	func(stock *Stock) {
+		stock.RefPrice = stock.Price
+		stock.BandBps = default_band_bps
+		stock.HaltBps = default_halt_bps
+	},
+}
+
+var user_upgrades = []func(*User){
+	// 0 -> 1: written before documents carried a version
+	func(user *User) {
+		user.ObjectType = "user"
+	},
+	// 1 -> 2: wallet moved to holding~user~stock keys, the migration or the next write of the wallet moves the positions
+	func(user *User) {},
+}
+
+var trade_upgrades = []func(*Trade){
+	// 0 -> 1: written before documents carried a version
+	func(trade *Trade) {
+		trade.ObjectType = "trade"
+	},
+	// 1 -> 2: price added, trades recorded before it have no execution price
+	func(trade *Trade) {},
+	// 2 -> 3: indexed by stock, buyer, seller and time, the migration writes the index entries
+	func(trade *Trade) {},
+	// 3 -> 4: terms_hash added, trades recorded before it have no private terms
+	func(trade *Trade) {},
+}
+
+func stock_version() int { return len(stock_upgrades) }
+func user_version() int  { return len(user_upgrades) }
+func trade_version() int { return len(trade_upgrades) }
+
+// Decode stock - parse a stored stock and upgrade it to the current schema version
+func decode_stock(stockAsBytes []byte) (Stock, error) {
+	var stock Stock
+	err := json.Unmarshal(stockAsBytes, &stock)
+	if err != nil {
+		return stock, errors.New("Failed to decode stock - " + err.Error())
+	}
+	if stock.Version > stock_version() {
+		return stock, errors.New("Stock " + stock.Id + " has unsupported schema version " + strconv.Itoa(stock.Version))
+	}
+	for ; stock.Version < stock_version(); stock.Version++ {
+		stock_upgrades[stock.Version](&stock)
+	}
+	return stock, nil
+}
+
+// Decode user - parse a stored user and upgrade it to the current schema version
+func decode_user(userAsBytes []byte) (User, error) {
+	var user User
+	err := json.Unmarshal(userAsBytes, &user)
+	if err != nil {
+		return user, errors.New("Failed to decode user - " + err.Error())
+	}
+	if user.Version > user_version() {
+		return user, errors.New("User " + user.Id + " has unsupported schema version " + strconv.Itoa(user.Version))
+	}
+	for ; user.Version < user_version(); user.Version++ {
+		user_upgrades[user.Version](&user)
+	}
+	return user, nil
+}
+
+// Decode trade - parse a stored trade and upgrade it to the current schema version
+func decode_trade(tradeAsBytes []byte) (Trade, error) {
+	var trade Trade
+	err := json.Unmarshal(tradeAsBytes, &trade)
+	if err != nil {
+		return trade, errors.New("Failed to decode transaction - " + err.Error())
+	}
+	if trade.Version > trade_version() {
+		return trade, errors.New("Transaction " + trade.Id + " has unsupported schema version " + strconv.Itoa(trade.Version))
+	}
+	for ; trade.Version < trade_version(); trade.Version++ {
+		trade_upgrades[trade.Version](&trade)
+	}
+	return trade, nil
+}
+
+// Migrate state - move the documents still stored under simple keys to the namespace of their type, upgrading
+// them to the current schema version, at most batch_size documents per call. Returns the simple key to pass as cursor
+// to the next call, or done when every simple key has been visited. Documents already in a namespace with an older
+// schema version are found by list_outdated and rewritten by upgrade_entities
+func migrate_state(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Result struct {
+		Scanned  int    `json:"scanned"`
+		Migrated int    `json:"migrated"`
+		Cursor   string `json:"cursor"`
+		Done     bool   `json:"done"`
+	}
+	var result Result
+	log_debug(stub, "starting")
+
+	batch_size, err := strconv.Atoi(args[0])
+	if err != nil || batch_size <= 0 {
+		return shim.Error("1st argument must be a positive numeric string")
+	}
+	cursor := min_key
+	if len(args) > 1 {
+		cursor = args[1]
+	}
+	if is_composite_key(cursor) {
+		return shim.Error("2nd argument must be a simple key")
+	}
+
+	uow := new_unit_of_work(stub)
+	result.Done = true
+
+	// documents under simple keys
+	resultsIterator, err := stub.GetStateByRange(cursor, max_key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return shim.Error(err.Error())
+		}
+		if is_composite_key(aKeyValue.Key) {
+			continue
+		}
+		if result.Scanned == batch_size {
+			result.Cursor = aKeyValue.Key
+			result.Done = false
+			break
+		}
+		result.Scanned++
+
+		migrated, err := migrate_document(uow, aKeyValue.Key, aKeyValue.Value)
+		if err != nil {
+			resultsIterator.Close()
+			return shim.Error("Failed to migrate " + aKeyValue.Key + " - " + err.Error())
+		}
+		if migrated {
+			result.Migrated++
+		}
+	}
+	resultsIterator.Close()
+
+	err = uow.commit()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "migrated", "migrated", result.Migrated, "scanned", result.Scanned, "done", result.Done)
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// Check namespace - the document type of a namespace argument
+func check_namespace(object_type string) error {
+	if !contains([]string{stock_namespace, user_namespace, trade_namespace}, object_type) {
+		return errors.New("namespace must be 'stock', 'user' or 'trade' - " + object_type)
+	}
+	return nil
+}
+
+// Schema version - the current schema version of a document type
+func schema_version(object_type string) int {
+	versions := map[string]int{stock_namespace: stock_version(), user_namespace: user_version(), trade_namespace: trade_version()}
+	return versions[object_type]
+}
+
+// List outdated - the ids of the documents of a namespace stored with an older schema version, reading one page
+// of page_size documents from the bookmark of the previous page. Composite keys cannot bound a range in a call
+// that writes, so the namespaces are walked by this read only call, whose paginated query resumes where the
+// previous page stopped, and the ids it returns are passed to upgrade_entities
+func list_outdated(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Result struct {
+		Ids      []string `json:"ids"`
+		Scanned  int      `json:"scanned"`
+		Bookmark string   `json:"bookmark"` // rỗng khi đã hết
+	}
+	var result Result
+
+	object_type := args[0]
+	err := check_namespace(object_type)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	page_size, err := strconv.Atoi(args[1])
+	if err != nil || page_size <= 0 || page_size > max_page_size {
+		return shim.Error("2nd argument must be a page size between 1 and " + strconv.Itoa(max_page_size))
+	}
+	bookmark := ""
+	if len(args) > 2 {
+		bookmark = args[2]
+	}
+
+	entityIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(object_type, []string{}, int32(page_size), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer entityIterator.Close()
+
+	version := schema_version(object_type)
+	for entityIterator.HasNext() {
+		aKeyValue, err := entityIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Scanned++
+		var header struct {
+			Version int `json:"version"`
+		}
+		// an undecodable document is left for audit_state to report
+		if json.Unmarshal(aKeyValue.Value, &header) != nil || header.Version >= version {
+			continue
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Ids = append(result.Ids, attributes[0])
+	}
+	if metadata != nil && metadata.FetchedRecordsCount == int32(page_size) {
+		result.Bookmark = metadata.Bookmark
+	}
+
+	//change to array of bytes
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// Upgrade entities - rewrite the documents of a namespace found by list_outdated to the current schema version
+func upgrade_entities(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Result struct {
+		Scanned  int `json:"scanned"`
+		Migrated int `json:"migrated"`
+	}
+	var result Result
+	log_debug(stub, "starting")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	object_type := args[0]
+	err := check_namespace(object_type)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ids, err := read_ids(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	uow := new_unit_of_work(stub)
+	for _, id := range ids {
+		key, err := entity_key(stub, object_type, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		value, err := uow.GetState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if value == nil {
+			continue
+		}
+		result.Scanned++
+
+		upgraded, err := upgrade_entity(uow, object_type, key, value)
+		if err != nil {
+			return shim.Error("Failed to upgrade " + key + " - " + err.Error())
+		}
+		if upgraded {
+			result.Migrated++
+		}
+	}
+
+	err = uow.commit()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "upgraded", "namespace", object_type, "migrated", result.Migrated, "scanned", result.Scanned)
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// Index stock code - write the code index entry of a stock stored before the index existed. When two such stocks
+// share a code the first one migrated keeps it, audit_state reports the other
+func index_stock_code(stub shim.ChaincodeStubInterface, stock Stock) error {
+	code_id, err := get_stock_id_by_code(stub, stock.Code)
+	if err != nil {
+		return err
+	}
+	if len(code_id) > 0 {
+		return nil
+	}
+	return put_stock_code(stub, stock)
+}
+
+// Index legacy stock - index the code of a stock stored before version 4, when it leaves its simple key
+func index_legacy_stock(stub shim.ChaincodeStubInterface, value []byte) error {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if json.Unmarshal(value, &header) != nil || header.Version >= 4 {
+		return nil
+	}
+	stock, err := decode_stock(value)
+	if err != nil {
+		return err
+	}
+	return index_stock_code(stub, stock)
+}
+
+// Upgrade document - decode a stored document of a type to the current schema version, writing the keys
+// its older versions did not have
+func upgrade_document(stub shim.ChaincodeStubInterface, object_type string, version int, value []byte) ([]byte, error) {
+	var doc interface{}
+	var err error
+	switch object_type {
+	case stock_namespace:
+		var stock Stock
+		stock, err = decode_stock(value)
+		if err == nil {
+			err = index_legacy_stock(stub, value)
+		}
+		doc = stock
+	case user_namespace:
+		var user User
+		user, err = decode_user(value)
+		if err == nil && len(user.Wallet) > 0 {
+			err = move_wallet(stub, &user)
+		}
+		doc = user
+	case trade_namespace:
+		var trade Trade
+		trade, err = decode_trade(value)
+		if err == nil && version < 3 {
+			err = index_trade(stub, trade)
+		}
+		doc = trade
+	}
+	if err != nil {
+		return nil, err
+	}
+	docAsBytes, _ := json.Marshal(doc)
+	return docAsBytes, nil
+}
+
+// Upgrade entity - rewrite a document already in its namespace when it is older than the current schema version,
+// reports whether it was rewritten
+func upgrade_entity(stub shim.ChaincodeStubInterface, object_type string, key string, value []byte) (bool, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	err := json.Unmarshal(value, &header)
+	if err != nil {
+		return false, err
+	}
+	if header.Version >= schema_version(object_type) {
+		return false, nil
+	}
+
+	docAsBytes, err := upgrade_document(stub, object_type, header.Version, value)
+	if err != nil {
+		return false, err
+	}
+	return true, stub.PutState(key, docAsBytes)
+}
+
+// Migrate document - upgrade a document stored under a simple key and move it to its namespace,
+// reports whether it was moved. A document whose namespaced key is already taken is left for audit_state
+func migrate_document(stub shim.ChaincodeStubInterface, key string, value []byte) (bool, error) {
+	var header struct {
+		ObjectType string `json:"docType"`
+		Version    int    `json:"version"`
+	}
+	err := json.Unmarshal(value, &header)
+	if err != nil {
+		return false, err
+	}
+
+	object_type := legacy_type(key, value)
+	switch object_type {
+	case stock_namespace, user_namespace, trade_namespace:
+	default:
+		return false, nil
+	}
+	entityKey, err := entity_key(stub, object_type, key)
+	if err != nil {
+		return false, err
+	}
+	entityAsBytes, err := stub.GetState(entityKey)
+	if err != nil {
+		return false, err
+	}
+	if entityAsBytes != nil {
+		return false, nil
+	}
+
+	docAsBytes, err := upgrade_document(stub, object_type, header.Version, value)
+	if err != nil {
+		return false, err
+	}
+	err = stub.PutState(entityKey, docAsBytes)
+	if err != nil {
+		return false, err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeStockUpgradesOldVersions(t *testing.T) {
+	stock, err := decode_stock([]byte(`{"id":"s9","code":"OLD","count":10,"price":4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stock.Version != stock_version() || stock.ObjectType != "stock" || stock.Status != stock_active ||
+		stock.RefPrice != 4 || stock.BandBps != default_band_bps || stock.HaltBps != default_halt_bps {
+		t.Fatalf("stock not upgraded - %+v", stock)
+	}
+
+	_, err = decode_stock([]byte(`{"id":"s9","version":99}`))
+	if err == nil {
+		t.Fatal("a newer schema version was decoded")
+	}
+}
+
+func TestMigrateStateResumesAtCursor(t *testing.T) {
+	sim := band_sim(t)
+	for _, id := range []string{"u7", "u8", "u9"} {
+		sim.state.put(id, []byte(`{"docType":"user","version":1,"id":"`+id+`","name":"Old","wallet":[{"id":"s1","count":1}]}`))
+	}
+
+	type Result struct {
+		Scanned  int    `json:"scanned"`
+		Migrated int    `json:"migrated"`
+		Cursor   string `json:"cursor"`
+		Done     bool   `json:"done"`
+	}
+	args := []string{"2"}
+	calls, migrated := 0, 0
+	for {
+		var result Result
+		err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "migrate_state", "2024-01-01T00:00:03Z", args...)), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		migrated += result.Migrated
+		if result.Done {
+			break
+		}
+		args = []string{"2", result.Cursor}
+	}
+	if calls != 2 || migrated != 3 {
+		t.Fatalf("%d documents migrated in %d calls", migrated, calls)
+	}
+
+	for _, id := range []string{"u7", "u8", "u9"} {
+		if sim.state.get(id) != nil {
+			t.Fatalf("%s left under its simple key", id)
+		}
+		key, _ := entity_key(sim.stub, user_namespace, id)
+		if value := string(sim.state.get(key)); strings.Contains(value, "wallet") {
+			t.Fatalf("wallet of %s not moved - %s", id, value)
+		}
+	}
+	band_call(t, sim, role_admin, false, "migrate_state", "2024-01-01T00:00:04Z", "2", "\x00user\x00u7\x00")
+}
+
+func TestListOutdatedResumesAtBookmark(t *testing.T) {
+	sim := band_sim(t)
+	for _, id := range []string{"s2", "s3", "s4"} {
+		key, _ := entity_key(sim.stub, stock_namespace, id)
+		sim.state.put(key, []byte(`{"docType":"stock","version":3,"id":"`+id+`","code":"C`+id+`","count":10,"price":5}`))
+	}
+
+	type Page struct {
+		Ids      []string `json:"ids"`
+		Scanned  int      `json:"scanned"`
+		Bookmark string   `json:"bookmark"`
+	}
+	var outdated []string
+	args := []string{stock_namespace, "2"}
+	for {
+		var page Page
+		err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "list_outdated", "2024-01-01T00:00:03Z", args...)), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outdated = append(outdated, page.Ids...)
+		if len(page.Bookmark) == 0 {
+			break
+		}
+		args = []string{stock_namespace, "2", page.Bookmark}
+	}
+	if strings.Join(outdated, ",") != "s2,s3,s4" {
+		t.Fatalf("outdated stocks - %v", outdated)
+	}
+
+	ids, _ := json.Marshal(append(outdated, "s1", "nobody"))
+	message := band_call(t, sim, role_admin, true, "upgrade_entities", "2024-01-01T00:00:04Z", stock_namespace, string(ids))
+	if message != `{"scanned":4,"migrated":3}` {
+		t.Fatalf("unexpected upgrade - %s", message)
+	}
+	var page Page
+	json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "list_outdated", "2024-01-01T00:00:05Z", stock_namespace, "10")), &page)
+	if len(page.Ids) != 0 || page.Scanned != 4 {
+		t.Fatalf("stocks still outdated - %+v", page)
+	}
+	band_call(t, sim, role_admin, true, "get_stock_by_code", "2024-01-01T00:00:06Z", "Cs3")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key indexes over trades, every index ends with the trade time and id so entries sort by time
+const (
+	trade_by_stock  = "trade~stock~time~id"
+	trade_by_buyer  = "trade~buyer~time~id"
+	trade_by_seller = "trade~seller~time~id"
+	trade_by_time   = "trade~time~id"
+)
+
+// Fixed width layout so index entries sort in time order
+const index_time_layout = "2006-01-02T15:04:05.000000000Z"
+
+// Default and maximum page size of search_transactions, and index entries fetched per query while searching
+const (
+	default_page_size = 50
+	max_page_size     = 500
+	index_chunk       = 100
+)
+
+// Index time - the sortable form of a trade time, times that cannot be parsed are indexed as given
+func index_time(value string) string {
+	t, err := parse_time(value)
+	if err != nil {
+		return value
+	}
+	return t.Format(index_time_layout)
+}
+
+// Index trade - write the index entries of a trade
+func index_trade(stub shim.ChaincodeStubInterface, trade Trade) error {
+	when := index_time(trade.Time)
+	entries := map[string][]string{
+		trade_by_stock:  {trade.Stock.Id, when, trade.Id},
+		trade_by_buyer:  {trade.Buyer.Id, when, trade.Id},
+		trade_by_seller: {trade.Seller.Id, when, trade.Id},
+		trade_by_time:   {when, trade.Id},
+	}
+	for index, attributes := range entries {
+		indexKey, err := stub.CreateCompositeKey(index, attributes)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get indexed trades - every trade found under a partial key of a trade index, in time order
+func get_indexed_trades(stub shim.ChaincodeStubInterface, index string, keys []string) ([]Trade, error) {
+	var trades []Trade
+
+	indexIterator, err := stub.GetStateByPartialCompositeKey(index, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer indexIterator.Close()
+
+	for indexIterator.HasNext() {
+		aKeyValue, err := indexIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, trade_id, err := split_index_key(stub, aKeyValue.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		trade, err := get_transaction(stub, trade_id)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+// Split index key - the time and trade id ending an entry of a trade index
+func split_index_key(stub shim.ChaincodeStubInterface, key string) (string, string, error) {
+	_, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if len(attributes) < 2 {
+		return "", "", errors.New("Invalid index entry - " + key)
+	}
+	return attributes[len(attributes)-2], attributes[len(attributes)-1], nil
+}
+
+// Walk index - visit in time order the entries of a trade index under a partial key from the start key
+// (from the first entry when empty). Entries are fetched a page of index_chunk at a time, so the walk reads
+// no further than the visitor needs; the visitor gets the key, time and trade id of an entry and returns false to stop.
+// Paginated queries are only served to read only calls
+func walk_index(stub shim.ChaincodeStubInterface, index string, keys []string, start string,
+	visit func(key string, when string, trade_id string) (bool, error)) error {
+	bookmark := start
+	for {
+		indexIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(index, keys, index_chunk, bookmark)
+		if err != nil {
+			return err
+		}
+		more := true
+		for more && indexIterator.HasNext() {
+			aKeyValue, err := indexIterator.Next()
+			if err != nil {
+				indexIterator.Close()
+				return err
+			}
+			when, trade_id, err := split_index_key(stub, aKeyValue.Key)
+			if err == nil {
+				more, err = visit(aKeyValue.Key, when, trade_id)
+			}
+			if err != nil {
+				indexIterator.Close()
+				return err
+			}
+		}
+		indexIterator.Close()
+		if !more || metadata == nil || len(metadata.Bookmark) == 0 || metadata.FetchedRecordsCount < index_chunk {
+			return nil
+		}
+		bookmark = metadata.Bookmark
+	}
+}
+
+// Search transactions - find trades by stock, buyer, seller, time range and count, sorted by time and paginated.
+// The most selective index is walked from the start of the time range, or from the bookmark: the index key of
+// the last trade of the previous page. An ascending search stops at the first match past the page, a descending
+// search reads the index entries of its range but only the trades from the end until the page is full.
+// The filter is a JSON object, every field is optional, counts are decimal strings:
+// {"stock_id", "buyer", "seller", "from", "to", "min_count", "max_count", "sort": "asc"|"desc", "page_size", "bookmark"}
+func search_transactions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Filter struct {
+		StockId  string `json:"stock_id"`
+		Buyer    string `json:"buyer"`
+		Seller   string `json:"seller"`
+		From     string `json:"from"`
+		To       string `json:"to"`
+		MinCount string `json:"min_count"`
+		MaxCount string `json:"max_count"`
+		Sort     string `json:"sort"`
+		PageSize int    `json:"page_size"`
+		Bookmark string `json:"bookmark"`
+	}
+
+	type Page struct {
+		Trans    []Trade `json:"transactions"`
+		Bookmark string  `json:"bookmark"` // rỗng khi đã hết kết quả
+	}
+
+	var filter Filter
+	err := json.Unmarshal([]byte(args[0]), &filter)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON filter - " + err.Error())
+	}
+
+	if filter.Sort != "" && filter.Sort != "asc" && filter.Sort != "desc" {
+		return shim.Error("sort must be 'asc' or 'desc'")
+	}
+	if filter.PageSize == 0 {
+		filter.PageSize = default_page_size
+	}
+	if filter.PageSize < 0 || filter.PageSize > max_page_size {
+		return shim.Error("page_size must be between 1 and " + strconv.Itoa(max_page_size))
+	}
+
+	// counts are compared across stocks with different unit scales at the finest scale
+	var min_count, max_count Amount
+	if len(filter.MinCount) > 0 {
+		min_count, err = parse_amount(filter.MinCount, max_scale)
+		if err != nil {
+			return shim.Error("min_count - " + err.Error())
+		}
+	}
+	if len(filter.MaxCount) > 0 {
+		max_count, err = parse_amount(filter.MaxCount, max_scale)
+		if err != nil {
+			return shim.Error("max_count - " + err.Error())
+		}
+	}
+
+	var from, to string
+	if len(filter.From) > 0 {
+		t, err := parse_time(filter.From)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		from = t.Format(index_time_layout)
+	}
+	if len(filter.To) > 0 {
+		t, err := parse_time(filter.To)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		to = t.Format(index_time_layout)
+	}
+
+	// walk the most selective index, the other filters are checked on each trade
+	index, keys := trade_by_time, []string{}
+	if len(filter.StockId) > 0 {
+		index, keys = trade_by_stock, []string{filter.StockId}
+	} else if len(filter.Buyer) > 0 {
+		index, keys = trade_by_buyer, []string{filter.Buyer}
+	} else if len(filter.Seller) > 0 {
+		index, keys = trade_by_seller, []string{filter.Seller}
+	}
+	prefix, err := stub.CreateCompositeKey(index, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(filter.Bookmark) > 0 && !strings.HasPrefix(filter.Bookmark, prefix) {
+		return shim.Error("Invalid bookmark - " + filter.Bookmark)
+	}
+	start := ""
+	if len(from) > 0 {
+		start, err = stub.CreateCompositeKey(index, append(keys, from))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	unit_scales := make(map[string]int)
+	match := func(trade_id string) (Trade, bool, error) {
+		trade, err := get_transaction(stub, trade_id)
+		if err != nil {
+			return trade, false, err
+		}
+		if len(filter.StockId) > 0 && trade.Stock.Id != filter.StockId {
+			return trade, false, nil
+		}
+		if len(filter.Buyer) > 0 && trade.Buyer.Id != filter.Buyer {
+			return trade, false, nil
+		}
+		if len(filter.Seller) > 0 && trade.Seller.Id != filter.Seller {
+			return trade, false, nil
+		}
+		unit_scale, found := unit_scales[trade.Stock.Id]
+		if !found {
+			stock, err := get_stock(stub, trade.Stock.Id)
+			if err != nil {
+				return trade, false, err
+			}
+			unit_scale = stock.UnitScale
+			unit_scales[trade.Stock.Id] = unit_scale
+		}
+		if len(filter.MinCount) > 0 && compare_amount(trade.Stock.Count, unit_scale, min_count, max_scale) < 0 {
+			return trade, false, nil
+		}
+		if len(filter.MaxCount) > 0 && compare_amount(trade.Stock.Count, unit_scale, max_count, max_scale) > 0 {
+			return trade, false, nil
+		}
+		return trade, true, nil
+	}
+
+	// add a matching trade to the page, false once a match past the page shows there is a next page
+	var page Page
+	var last string
+	add := func(key string, trade_id string) (bool, error) {
+		trade, matched, err := match(trade_id)
+		if err != nil || !matched {
+			return true, err
+		}
+		if len(page.Trans) == filter.PageSize {
+			page.Bookmark = last
+			return false, nil
+		}
+		page.Trans = append(page.Trans, trade)
+		last = key
+		return true, nil
+	}
+
+	if filter.Sort == "desc" {
+		// index entries of the range before the bookmark, then trades from the latest
+		var entries [][2]string
+		err = walk_index(stub, index, keys, start, func(key string, when string, trade_id string) (bool, error) {
+			if (len(to) > 0 && when > to) || (len(filter.Bookmark) > 0 && key >= filter.Bookmark) {
+				return false, nil
+			}
+			entries = append(entries, [2]string{key, trade_id})
+			return true, nil
+		})
+		for i := len(entries) - 1; err == nil && i >= 0; i-- {
+			var more bool
+			more, err = add(entries[i][0], entries[i][1])
+			if !more {
+				break
+			}
+		}
+	} else {
+		if len(filter.Bookmark) > 0 {
+			start = filter.Bookmark
+		}
+		err = walk_index(stub, index, keys, start, func(key string, when string, trade_id string) (bool, error) {
+			if key == filter.Bookmark {
+				return true, nil
+			}
+			if len(to) > 0 && when > to {
+				return false, nil
+			}
+			return add(key, trade_id)
+		})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	log_debug(stub, "search", "returned", len(page.Trans))
+
+	//change to array of bytes
+	pageAsBytes, _ := json.Marshal(page)
+	return shim.Success(pageAsBytes)
+}
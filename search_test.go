@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Search sim - the band sim where u1 sells 100 of s1 to u2 on 2024-01-01, then 120 unpriced trades of s1 between
+// them, one a minute from 2024-01-02: trade i is sold by u2 when i is a multiple of 3 and counts 1 + i%4
+func search_sim(t *testing.T) *Simulator {
+	sim := band_sim(t)
+	band_call(t, sim, role_admin, true, "init_transaction", "2024-01-01T12:00:00Z", "t_seed", "s1", "100", "u1", "u2", "2024-01-01T12:00:00Z")
+	for i := 0; i < 120; i++ {
+		at := fmt.Sprintf("2024-01-02T%02d:%02d:00Z", i/60, i%60)
+		seller, buyer := "u1", "u2"
+		if i%3 == 0 {
+			seller, buyer = "u2", "u1"
+		}
+		band_call(t, sim, role_admin, true, "init_transaction", at, fmt.Sprintf("t%03d", i), "s1", fmt.Sprint(1+i%4), seller, buyer, at)
+	}
+	return sim
+}
+
+// Search all - follow the bookmarks of a search until the last page, returns the trade ids in page order
+func search_all(t *testing.T, sim *Simulator, filter map[string]interface{}) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		filterAsBytes, _ := json.Marshal(filter)
+		var page struct {
+			Trans    []Trade `json:"transactions"`
+			Bookmark string  `json:"bookmark"`
+		}
+		err := json.Unmarshal([]byte(band_call(t, sim, role_admin, true, "search_transactions", "2024-02-01T00:00:00Z", string(filterAsBytes))), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, trade := range page.Trans {
+			ids = append(ids, trade.Id)
+		}
+		if len(page.Bookmark) == 0 {
+			return ids
+		}
+		if len(page.Trans) == 0 || pages > 100 {
+			t.Fatalf("bookmark %q returned with page %d", page.Bookmark, pages)
+		}
+		filter["bookmark"] = page.Bookmark
+	}
+}
+
+func TestSearchBookmarksCoverEveryTradeOnce(t *testing.T) {
+	sim := search_sim(t)
+	var want []string
+	for i := 0; i < 120; i++ {
+		want = append(want, fmt.Sprintf("t%03d", i))
+	}
+
+	ids := search_all(t, sim, map[string]interface{}{"stock_id": "s1", "page_size": 7, "from": "2024-01-02"})
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("ascending pages - %v", ids)
+	}
+
+	ids = search_all(t, sim, map[string]interface{}{"stock_id": "s1", "page_size": 7, "from": "2024-01-02", "sort": "desc"})
+	for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+		want[i], want[j] = want[j], want[i]
+	}
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("descending pages - %v", ids)
+	}
+}
+
+func TestSearchFiltersByCounterpartyTimeAndCount(t *testing.T) {
+	sim := search_sim(t)
+	ids := search_all(t, sim, map[string]interface{}{"buyer": "u1", "min_count": "4", "page_size": 3,
+		"from": "2024-01-02T00:10:00Z", "to": "2024-01-02T01:00:00Z"})
+	// sold by u2 and counting 4: i%3 == 0 and i%4 == 3, i.e. i = 15, 27, 39, 51 within minutes 10 to 60
+	if strings.Join(ids, ",") != "t015,t027,t039,t051" {
+		t.Fatalf("filtered trades - %v", ids)
+	}
+
+	ids = search_all(t, sim, map[string]interface{}{"seller": "u2", "max_count": "1", "page_size": 50, "sort": "desc"})
+	if len(ids) != 10 || ids[0] != "t108" || ids[9] != "t000" {
+		t.Fatalf("filtered trades - %v", ids)
+	}
+
+	message := band_call(t, sim, role_admin, false, "search_transactions", "2024-02-01T00:00:00Z", `{"stock_id":"s1","bookmark":"t001"}`)
+	if !strings.Contains(message, "Invalid bookmark") {
+		t.Fatalf("unexpected error - %s", message)
+	}
+}
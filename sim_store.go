@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// Highest level of the skip list, enough for hundreds of millions of keys
+const sim_levels = 28
+
+// ----- SimNode ----- //
+type SimNode struct {
+	key   string
+	value []byte
+	next  []*SimNode
+}
+
+// ----- SimStore ----- //
+// SimStore is the world state of the simulator: a skip list keeping keys in order for range queries
+// and a map for point reads. The MockStub keeps its keys in a linked list, which makes every write
+// and range query walk the whole state and does not scale to millions of keys
+type SimStore struct {
+	head  *SimNode
+	level int
+	keys  map[string]*SimNode
+	seed  uint64 // trạng thái xorshift chọn tầng
+}
+
+// New sim store - an empty state
+func new_sim_store() *SimStore {
+	return &SimStore{
+		head:  &SimNode{next: make([]*SimNode, sim_levels)},
+		level: 1,
+		keys:  make(map[string]*SimNode),
+		seed:  88172645463325252,
+	}
+}
+
+// Random level - the number of levels of a new node, each level with probability 1/4
+func (store *SimStore) random_level() int {
+	level := 1
+	for level < sim_levels {
+		store.seed ^= store.seed << 13
+		store.seed ^= store.seed >> 7
+		store.seed ^= store.seed << 17
+		if store.seed&3 != 0 {
+			break
+		}
+		level++
+	}
+	return level
+}
+
+// Predecessors - at every level, the last node whose key is before the given key
+func (store *SimStore) predecessors(key string) []*SimNode {
+	update := make([]*SimNode, sim_levels)
+	node := store.head
+	for i := store.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Get - the value of a key, nil when absent
+func (store *SimStore) get(key string) []byte {
+	if node, found := store.keys[key]; found {
+		return node.value
+	}
+	return nil
+}
+
+// Put - write a key, an empty value deletes it
+func (store *SimStore) put(key string, value []byte) {
+	if len(value) == 0 {
+		store.del(key)
+		return
+	}
+	if node, found := store.keys[key]; found {
+		node.value = value
+		return
+	}
+
+	update := store.predecessors(key)
+	level := store.random_level()
+	for i := store.level; i < level; i++ {
+		update[i] = store.head
+	}
+	if level > store.level {
+		store.level = level
+	}
+	node := &SimNode{key: key, value: value, next: make([]*SimNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	store.keys[key] = node
+}
+
+// Del - remove a key
+func (store *SimStore) del(key string) {
+	node, found := store.keys[key]
+	if !found {
+		return
+	}
+	update := store.predecessors(key)
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	delete(store.keys, key)
+}
+
+// Each - visit every key in order
+func (store *SimStore) each(visit func(key string, value []byte)) {
+	for node := store.head.next[0]; node != nil; node = node.next[0] {
+		visit(node.key, node.value)
+	}
+}
+
+// Scan - iterate the keys in [start, end), an empty end is unbounded
+func (store *SimStore) scan(start string, end string) *SimRangeIterator {
+	node := store.predecessors(start)[0].next[0]
+	return &SimRangeIterator{node: node, end: end}
+}
+
+// ----- SimRangeIterator ----- //
+type SimRangeIterator struct {
+	node  *SimNode
+	end   string
+	stats *SimStats
+}
+
+func (iterator *SimRangeIterator) HasNext() bool {
+	return iterator.node != nil && (len(iterator.end) == 0 || iterator.node.key < iterator.end)
+}
+
+func (iterator *SimRangeIterator) Next() (*queryresult.KV, error) {
+	if !iterator.HasNext() {
+		return nil, errors.New("no more keys")
+	}
+	if iterator.stats != nil {
+		iterator.stats.Reads++
+	}
+	kv := &queryresult.KV{Key: iterator.node.key, Value: iterator.node.value}
+	iterator.node = iterator.node.next[0]
+	return kv, nil
+}
+
+func (iterator *SimRangeIterator) Close() error { return nil }
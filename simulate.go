@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ========================================================
+// Offline simulator - host the chaincode on a MockStub and run a script of calls without a Fabric network:
+//
+//	stocks simulate [-load state.json] [-script calls.jsonl] [-dump state.json] [-role admin] [-msp Org1MSP]
+//
+// The script has one JSON call per line, {"id", "function", "args", "transient", "role", "msp", "user", "timestamp"},
+// and one JSON response per call is printed. Like on a peer, a call reads the state committed by the calls
+// before it and its writes are only committed when it succeeds
+// ========================================================
+
+// ----- ScriptCall ----- //
+type ScriptCall struct {
+	Id        string                     `json:"id"` // mã yêu cầu, chỉ để đối chiếu
+	Function  string                     `json:"function"`
+	Args      []string                   `json:"args"`
+	Transient map[string]json.RawMessage `json:"transient"` // chuỗi JSON được truyền nguyên nội dung
+	Role      string                     `json:"role"`      // mặc định theo -role
+	Msp       string                     `json:"msp"`       // mặc định theo -msp
+	User      string                     `json:"user"`      // người dùng mà người gọi đại diện, theo thuộc tính user_id
+	Timestamp string                     `json:"timestamp"` // mặc định là thời điểm chạy
+}
+
+// ----- ScriptResult ----- //
+type ScriptResult struct {
+	Id       string          `json:"id,omitempty"`
+	Function string          `json:"function"`
+	TxId     string          `json:"tx_id"`
+	Status   int32           `json:"status"`
+	Message  string          `json:"message,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Stats    SimStats        `json:"-"`
+}
+
+// ----- SimStats ----- //
+// State access of one call, measured by the load generator
+type SimStats struct {
+	Duration time.Duration
+	Reads    int // số khóa đã đọc, kể cả qua truy vấn khoảng
+	Queries  int // số truy vấn khoảng và lịch sử
+	Writes   int
+}
+
+// ----- SimModification ----- //
+type SimModification struct {
+	TxId      string `json:"tx_id"`
+	Timestamp string `json:"timestamp"`
+	Value     string `json:"value"`
+	IsDelete  bool   `json:"is_delete"`
+}
+
+// ----- SimState ----- //
+// World state dumped by the simulator, values are kept as strings since the chaincode only stores JSON documents
+// and index markers
+type SimState struct {
+	State   map[string]string            `json:"state"`
+	Private map[string]map[string]string `json:"private"`
+	History map[string][]SimModification `json:"history"`
+}
+
+// ----- Simulator ----- //
+type Simulator struct {
+	stub    *shim.MockStub // khóa tổng hợp, dữ liệu riêng và mã giao dịch
+	state   *SimStore
+	history map[string][]*queryresult.KeyModification // lịch sử theo khóa, cũ trước
+	count   int                                       // số của mã giao dịch cuối, kể cả lịch sử đã nạp
+}
+
+// New simulator - an empty world state
+func new_simulator() *Simulator {
+	return &Simulator{
+		stub:    shim.NewMockStub("stocks", new(SimpleChaincode)),
+		state:   new_sim_store(),
+		history: make(map[string][]*queryresult.KeyModification),
+	}
+}
+
+// ----- SimStub ----- //
+// SimStub is the stub of one call: it serves the call's arguments, transient map and timestamp,
+// reads the committed state and keeps the writes until the call succeeds
+type SimStub struct {
+	*shim.MockStub
+	sim       *Simulator
+	args      [][]byte
+	transient map[string][]byte
+	timestamp *timestamp.Timestamp
+	keys      []string
+	writes    map[string][]byte // nil là xóa
+	private   [][3]string       // collection, key, value
+	stats     SimStats
+}
+
+func (stub *SimStub) GetArgs() [][]byte { return stub.args }
+
+func (stub *SimStub) GetStringArgs() []string {
+	var args []string
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *SimStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (stub *SimStub) GetTransient() (map[string][]byte, error) { return stub.transient, nil }
+
+func (stub *SimStub) GetTxTimestamp() (*timestamp.Timestamp, error) { return stub.timestamp, nil }
+
+func (stub *SimStub) GetState(key string) ([]byte, error) {
+	stub.stats.Reads++
+	return stub.sim.state.get(key), nil
+}
+
+func (stub *SimStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	stub.stats.Queries++
+	iterator := stub.sim.state.scan(startKey, endKey)
+	iterator.stats = &stub.stats
+	return iterator, nil
+}
+
+func (stub *SimStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetStateByRange(prefix, prefix+max_key)
+}
+
+// Pages start at the bookmark, the bookmark returned is the first key of the next page, empty after the last page
+func (stub *SimStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := prefix
+	if len(bookmark) > 0 {
+		if !strings.HasPrefix(bookmark, prefix) {
+			return nil, nil, errors.New("invalid bookmark")
+		}
+		start = bookmark
+	}
+
+	stub.stats.Queries++
+	metadata := &pb.QueryResponseMetadata{}
+	peek := stub.sim.state.scan(start, prefix+max_key)
+	for peek.HasNext() && metadata.FetchedRecordsCount < pageSize {
+		peek.node = peek.node.next[0]
+		metadata.FetchedRecordsCount++
+	}
+	end := prefix + max_key
+	if peek.HasNext() {
+		metadata.Bookmark = peek.node.key
+		end = metadata.Bookmark
+	}
+	iterator := stub.sim.state.scan(start, end)
+	iterator.stats = &stub.stats
+	return iterator, metadata, nil
+}
+
+func (stub *SimStub) PutState(key string, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("key must not be an empty string")
+	}
+	if _, found := stub.writes[key]; !found {
+		stub.keys = append(stub.keys, key)
+	}
+	stub.writes[key] = value
+	return nil
+}
+
+func (stub *SimStub) DelState(key string) error {
+	return stub.PutState(key, nil)
+}
+
+func (stub *SimStub) PutPrivateData(collection string, key string, value []byte) error {
+	stub.private = append(stub.private, [3]string{collection, key, string(value)})
+	return nil
+}
+
+func (stub *SimStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	stub.stats.Queries++
+	stub.stats.Reads += len(stub.sim.history[key])
+	return &SimHistoryIterator{modifications: stub.sim.history[key]}, nil
+}
+
+// ----- SimHistoryIterator ----- //
+type SimHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+	next          int
+}
+
+func (iterator *SimHistoryIterator) HasNext() bool {
+	return iterator.next < len(iterator.modifications)
+}
+
+func (iterator *SimHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if !iterator.HasNext() {
+		return nil, errors.New("no more modifications")
+	}
+	iterator.next++
+	return iterator.modifications[iterator.next-1], nil
+}
+
+func (iterator *SimHistoryIterator) Close() error { return nil }
+
+// Run - execute one call, committing its writes and recording their history when it succeeds
+func (sim *Simulator) run(call ScriptCall, role string, msp string) ScriptResult {
+	sim.count++
+	tx_id := "sim" + strconv.Itoa(sim.count)
+	result := ScriptResult{Id: call.Id, Function: call.Function, TxId: tx_id}
+
+	when := time.Now().UTC()
+	if len(call.Timestamp) > 0 {
+		at, err := parse_time(call.Timestamp)
+		if err != nil {
+			result.Status = shim.ERROR
+			result.Message = err.Error()
+			return result
+		}
+		when = at
+	}
+	stamp, _ := ptypes.TimestampProto(when)
+
+	stub := &SimStub{MockStub: sim.stub, sim: sim, timestamp: stamp, writes: make(map[string][]byte)}
+	stub.args = append(stub.args, []byte(call.Function))
+	for _, arg := range call.Args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	if len(call.Transient) > 0 {
+		stub.transient = make(map[string][]byte)
+		for name, value := range call.Transient {
+			var text string
+			if json.Unmarshal(value, &text) == nil {
+				stub.transient[name] = []byte(text)
+			} else {
+				stub.transient[name] = value
+			}
+		}
+	}
+	if len(call.Role) > 0 {
+		role = call.Role
+	}
+	if len(call.Msp) > 0 {
+		msp = call.Msp
+	}
+	get_caller_role = func(stub shim.ChaincodeStubInterface) (string, error) { return role, nil }
+	get_caller_msp = func(stub shim.ChaincodeStubInterface) (string, error) { return msp, nil }
+	get_caller_user = func(stub shim.ChaincodeStubInterface) (string, error) {
+		if len(call.User) == 0 {
+			return "", errors.New("attribute '" + user_attribute + "' not found")
+		}
+		return call.User, nil
+	}
+
+	sim.stub.MockTransactionStart(tx_id)
+	sim.stub.TxTimestamp = stamp
+	start := time.Now()
+	response := new(SimpleChaincode).Invoke(stub)
+	stub.stats.Duration = time.Since(start)
+	stub.stats.Writes = len(stub.keys) + len(stub.private)
+	result.Stats = stub.stats
+	if response.Status == shim.OK {
+		sim.commit(stub)
+	}
+	sim.stub.MockTransactionEnd(tx_id)
+
+	result.Status = response.Status
+	result.Message = response.Message
+	if len(response.Payload) > 0 {
+		if json.Valid(response.Payload) {
+			result.Payload = response.Payload
+		} else {
+			result.Payload, _ = json.Marshal(string(response.Payload))
+		}
+	}
+	return result
+}
+
+// Commit - apply the writes of a successful call to the world state
+func (sim *Simulator) commit(stub *SimStub) {
+	for _, key := range stub.keys {
+		value := stub.writes[key]
+		modification := &queryresult.KeyModification{TxId: stub.GetTxID(), Value: value, Timestamp: stub.timestamp}
+		if len(value) == 0 {
+			modification.IsDelete = true
+		}
+		sim.state.put(key, value)
+		sim.history[key] = append(sim.history[key], modification)
+	}
+	for _, entry := range stub.private {
+		sim.stub.PutPrivateData(entry[0], entry[1], []byte(entry[2]))
+	}
+}
+
+// Load - restore a world state dumped by the simulator
+func (sim *Simulator) load(reader io.Reader) error {
+	var state SimState
+	err := json.NewDecoder(reader).Decode(&state)
+	if err != nil {
+		return errors.New("Failed to read state - " + err.Error())
+	}
+
+	sim.stub.MockTransactionStart("load")
+	defer sim.stub.MockTransactionEnd("load")
+	for key, value := range state.State {
+		sim.state.put(key, []byte(value))
+	}
+	for collection, values := range state.Private {
+		for key, value := range values {
+			sim.stub.PutPrivateData(collection, key, []byte(value))
+		}
+	}
+	for key, modifications := range state.History {
+		for _, modification := range modifications {
+			at, err := time.Parse(time.RFC3339Nano, modification.Timestamp)
+			if err != nil {
+				return errors.New("Failed to read history of " + key + " - " + err.Error())
+			}
+			stamp, _ := ptypes.TimestampProto(at)
+			sim.history[key] = append(sim.history[key], &queryresult.KeyModification{TxId: modification.TxId,
+				Value: []byte(modification.Value), Timestamp: stamp, IsDelete: modification.IsDelete})
+
+			// continue the transaction ids of the dump so new delta keys do not collide with loaded ones
+			if len(modification.TxId) > 3 && modification.TxId[:3] == "sim" {
+				count, err := strconv.Atoi(modification.TxId[3:])
+				if err == nil && count > sim.count {
+					sim.count = count
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Dump - write the world state, private data and key history
+func (sim *Simulator) dump(writer io.Writer) error {
+	state := SimState{
+		State:   make(map[string]string),
+		Private: make(map[string]map[string]string),
+		History: make(map[string][]SimModification),
+	}
+	sim.state.each(func(key string, value []byte) {
+		state.State[key] = string(value)
+	})
+	for collection, values := range sim.stub.PvtState {
+		state.Private[collection] = make(map[string]string)
+		for key, value := range values {
+			state.Private[collection][key] = string(value)
+		}
+	}
+	for key, modifications := range sim.history {
+		for _, modification := range modifications {
+			at, _ := ptypes.Timestamp(modification.Timestamp)
+			state.History[key] = append(state.History[key], SimModification{TxId: modification.TxId,
+				Timestamp: at.Format(time.RFC3339Nano), Value: string(modification.Value), IsDelete: modification.IsDelete})
+		}
+	}
+
+	stateAsBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(stateAsBytes, '\n'))
+	return err
+}
+
+// Simulate - the simulate command, returns the exit code
+func simulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	load := flags.String("load", "", "world state file to start from")
+	script := flags.String("script", "-", "script of calls, one JSON object per line, - for stdin")
+	dump := flags.String("dump", "", "file to write the resulting world state to")
+	role := flags.String("role", role_admin, "default role of the caller")
+	msp := flags.String("msp", "Org1MSP", "default MSP id of the caller")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	sim := new_simulator()
+	if len(*load) > 0 {
+		file, err := os.Open(*load)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		err = sim.load(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	input := io.Reader(os.Stdin)
+	if *script != "-" {
+		scriptAsBytes, err := ioutil.ReadFile(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		input = bytes.NewReader(scriptAsBytes)
+	}
+
+	// chaincode logs go to stderr so stdout only carries the responses
+	log_output = os.Stderr
+	defer func() { log_output = nil }()
+	output := json.NewEncoder(os.Stdout)
+
+	calls, failed := 0, 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Bytes()
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		var call ScriptCall
+		err := json.Unmarshal(text, &call)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "line "+strconv.Itoa(line)+" - "+err.Error())
+			return 1
+		}
+		result := sim.run(call, *role, *msp)
+		calls++
+		if result.Status != shim.OK {
+			failed++
+		}
+		output.Encode(result)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(*dump) > 0 {
+		file, err := os.Create(*dump)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		err = sim.dump(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	fmt.Fprintln(os.Stderr, strconv.Itoa(calls)+" calls, "+strconv.Itoa(failed)+" failed")
+	return 0
+}
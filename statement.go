@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ========================================================
+// Statement renderer - turn the output of get_statement into a CSV file or a printable HTML page, off chain:
+//
+//	peer chaincode query ... '{"Args":["get_statement","u1","2024-01-01","2024-02-01"]}' > statement.json
+//	stocks statement [-in statement.json] [-format csv|html] > statement.html
+//
+// The CSV has one row per movement, framed by an opening and a closing row for each stock
+// ========================================================
+
+// Render statement csv - one row per movement with the opening and closing balances of each stock
+func render_statement_csv(writer io.Writer, statement Statement) error {
+	output := csv.NewWriter(writer)
+	output.Write([]string{"user_id", "stock_id", "code", "time", "tx_id", "cause", "ref", "counterparty", "count", "balance"})
+	for _, line := range statement.Stocks {
+		output.Write([]string{statement.UserId, line.StockId, line.Code, statement.From, "", "opening", "", "", "",
+			format_amount(line.Opening, line.UnitScale)})
+		for _, movement := range line.Movements {
+			output.Write([]string{statement.UserId, line.StockId, line.Code, movement.Time, movement.TxId, movement.Cause,
+				movement.Ref, movement.Counterparty, format_amount(movement.Count, line.UnitScale),
+				format_amount(movement.Balance, line.UnitScale)})
+		}
+		output.Write([]string{statement.UserId, line.StockId, line.Code, statement.To, "", "closing", "", "", "",
+			format_amount(line.Closing, line.UnitScale)})
+	}
+	output.Flush()
+	return output.Error()
+}
+
+// Printable statement, amounts are formatted with the unit scale of their stock
+var statement_template = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"amount": format_amount,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Statement {{.UserId}} {{.From}} - {{.To}}</title>
+<style>
+body { font-family: sans-serif; font-size: 11pt; margin: 2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; page-break-inside: avoid; }
+th, td { border-bottom: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.amount, th.amount { text-align: right; }
+tr.balance td { font-weight: bold; }
+p.warning { color: #a00; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>Account statement</h1>
+<p>{{.Name}} ({{.UserId}})<br>From {{.From}} to {{.To}}</p>
+{{if not .Reconciled}}<p class="warning">The recorded changes do not add up to the current wallet of every stock.</p>{{end}}
+{{range .Stocks}}{{$scale := .UnitScale}}
+<h2>{{.Code}} ({{.StockId}})</h2>
+<table>
+<tr><th>Time</th><th>Transaction</th><th>Cause</th><th>Reference</th><th>Counterparty</th><th class="amount">Count</th><th class="amount">Balance</th></tr>
+<tr class="balance"><td colspan="6">Opening balance</td><td class="amount">{{amount .Opening $scale}}</td></tr>
+{{range .Movements}}<tr><td>{{.Time}}</td><td>{{.TxId}}</td><td>{{.Cause}}</td><td>{{.Ref}}</td><td>{{.Counterparty}}</td><td class="amount">{{amount .Count $scale}}</td><td class="amount">{{amount .Balance $scale}}</td></tr>
+{{end}}<tr class="balance"><td colspan="6">Closing balance</td><td class="amount">{{amount .Closing $scale}}</td></tr>
+</table>
+{{if not .Reconciled}}<p class="warning">Current wallet holds {{amount .Current $scale}}.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// Render statement html - a printable page with a table per stock
+func render_statement_html(writer io.Writer, statement Statement) error {
+	return statement_template.Execute(writer, statement)
+}
+
+// Statement - the statement command, returns the exit status
+func statement(args []string) int {
+	flags := flag.NewFlagSet("statement", flag.ContinueOnError)
+	in := flags.String("in", "-", "output of get_statement, - for stdin")
+	format := flags.String("format", "html", "csv or html")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	var statementAsBytes []byte
+	var err error
+	if *in == "-" {
+		statementAsBytes, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		statementAsBytes, err = ioutil.ReadFile(*in)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var statement Statement
+	err = json.Unmarshal(statementAsBytes, &statement)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to decode statement - "+err.Error())
+		return 1
+	}
+
+	switch *format {
+	case "csv":
+		err = render_statement_csv(os.Stdout, statement)
+	case "html":
+		err = render_statement_html(os.Stdout, statement)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown format - "+*format)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"os"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -14,19 +14,29 @@ type SimpleChaincode struct {
 // ----- Stock ----- //
 type Stock struct {
 	ObjectType 	string        	`json:"docType"` 	// field for couchdb
+	Version 	int 			`json:"version"`		// phiên bản schema
 	Id       	string          `json:"id"`
 	Code       	string          `json:"code"`      	// mã
-	Count      	int        		`json:"count"`		// số lượng chứng chỉ tạo ra
-	Price       int         	`json:"price"`    	// giá một chứng chỉ
+	Count      	Amount     		`json:"count"`		// số lượng chứng chỉ tạo ra
+	Price       Amount      	`json:"price"`    	// giá một chứng chỉ
+	PriceScale 	int 			`json:"price_scale"`	// số chữ số thập phân của giá
+	UnitScale 	int 			`json:"unit_scale"`	// số chữ số thập phân của số lượng
+	MinLot 		Amount 			`json:"min_lot"`		// số lượng tối thiểu mỗi lệnh
+	Status 		string 			`json:"status"`		// trạng thái: active, suspended, halted, delisted
+	RefPrice 	Amount 			`json:"ref_price"`	// giá tham chiếu trong ngày
+	RefDay 		string 			`json:"ref_day"`		// ngày của giá tham chiếu
+	BandBps 	int 			`json:"band_bps"`		// biên độ giá quanh giá tham chiếu, phần vạn, 0 là không giới hạn
+	HaltBps 	int 			`json:"halt_bps"`		// ngưỡng ngắt mạch, phần vạn, 0 là không ngắt
 	Creator     UserInfo 		`json:"creator"`		// người tạo
 }
 
 // ----- User ----- //
 type User struct {
 	ObjectType 	string 			`json:"docType"`    // field for couchdb
+	Version 	int 			`json:"version"`		// phiên bản schema
 	Id        	string 			`json:"id"`			
 	Name   		string 			`json:"name"`		// tên
-	Wallet    	[]Asset 		`json:"wallet"`		// ví
+	Wallet    	[]Asset 		`json:"wallet,omitempty"`	// ví, chỉ còn trong tài liệu trước phiên bản 2
 }
 
 // ----- UserInfo ----- //
@@ -39,24 +49,39 @@ type UserInfo struct {
 type Asset struct {
 	Id 			string 			`json:"id"`
 	Code        string 			`json:"code"`		// mã chứng chỉ quỹ
-	Count   	int 			`json:"count"`  	// số lượng
+	Count   	Amount 			`json:"count"`  	// số lượng
 }
 
 // ----- Trade ----- //
 type Trade struct {
 	ObjectType 	string 			`json:"docType"`    // field for couchdb
+	Version 	int 			`json:"version"`		// phiên bản schema
 	Id			string 			`json:"id"`	
 	Stock 		Asset			`json:"stock"`		// mã
 	Seller		UserInfo		`json:"seller"`		// thông tin người bán
 	Buyer		UserInfo		`json:"buyer"`		// thông tin người mua
 	Time 		string 			`json:"time"`		// thời gian giao dịch
+	Price 		Amount 			`json:"price,omitempty"`	// giá khớp lệnh, 0 nếu không rõ
+	TermsHash 	string 			`json:"terms_hash,omitempty"`	// hash điều khoản riêng tư
 }
 
 // Main
 func main() {
+	// offline tools, see simulate.go, loadgen.go and statement.go
+	configure_logging()
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		os.Exit(loadgen(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "statement" {
+		os.Exit(statement(os.Args[2:]))
+	}
+
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode - %s", err)
+		log_error(nil, "error starting chaincode", "err", err)
 	}
 }
 
@@ -69,37 +94,26 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 // Invoke - Our entry point for Invocations
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
-	fmt.Println(" ")
-	fmt.Println("starting invoke, for - " + function)
+	log_info(stub, "invoke", "args", len(args))
 
 	// Handle different functions
-	if function == "init" {                    					// khởi tạo trạng thái
-		return t.Init(stub)
-	} else if function == "init_stock" {      					// tạo chứng chỉ quỹ
-		return init_stock(stub, args)
-	} else if function == "update_price" {      				// cập nhật giá chứng chỉ quỹ
-		return update_price(stub, args)
-	} else if function == "get_list_stock"{    					// xem toàn bộ mã chứng chỉ quỹ
-		return get_list_stock(stub)
-	} else if function == "init_user" {      					// tạo người dùng
-		return init_user(stub, args)
-	} else if function == "init_transaction"{   				// tạo giao dịch
-		return init_transaction(stub, args)
-	} else if function == "get_list_user"{    					// xem toàn bộ mã chứng chỉ quỹ
-		return get_list_user(stub)
-	} else if function == "get_list_transaction"{   			// xem toàn bộ danh sách các giao dịch
-		return get_list_transaction(stub)
-	} else if function == "get_list_transaction_by_user"{    	// danh sách các giao dịch của người dùng với id nhập vào
-		return get_list_transaction_by_user(stub, args)
-	} else if function == "get_list_user_have_stock_by_id"{    	// danh sách thông tin người dùng và số lượng mã người dùng đó có với mã có id nhập vào
-		return get_list_user_have_stock_by_id(stub, args)
+	fn, found := find_function(function)
+	if !found {
+		// error out
+		log_warning(stub, "unknown function")
+		return shim.Error("Received unknown invoke function name - '" + function + "'")
 	}
 
-	// error out
-	fmt.Println("Received unknown invoke function name - " + function)
-	return shim.Error("Received unknown invoke function name - '" + function + "'")
-}
+	err := check_arguments(fn, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = check_role(stub, fn.Role)
+	if err != nil {
+		log_warning(stub, "access denied", "err", err)
+		return shim.Error(err.Error())
+	}
 
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Error("Unknown supported call - Query()")
+	return fn.Handler(stub, args)
 }
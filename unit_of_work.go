@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// ----- UnitOfWork ----- //
+// UnitOfWork stages the writes of one function so nothing reaches the proposal until every
+// invariant is checked. It is passed wherever a stub is expected: point and range reads see the staged writes,
+// writes are kept in memory and only emitted by commit, all other calls go to the real stub
+type UnitOfWork struct {
+	shim.ChaincodeStubInterface
+	keys    []string          // thứ tự ghi đầu tiên
+	writes  map[string][]byte // nil là xóa
+	private map[string]map[string][]byte
+	order   [][2]string // collection, key của dữ liệu riêng
+}
+
+// New unit of work - stage the writes of a function on top of the stub
+func new_unit_of_work(stub shim.ChaincodeStubInterface) *UnitOfWork {
+	return &UnitOfWork{
+		ChaincodeStubInterface: stub,
+		writes:                 make(map[string][]byte),
+		private:                make(map[string]map[string][]byte),
+	}
+}
+
+// GetState - the staged value of a key if it was written in this unit, the ledger value otherwise
+func (uow *UnitOfWork) GetState(key string) ([]byte, error) {
+	if value, found := uow.writes[key]; found {
+		if len(value) == 0 {
+			return nil, nil
+		}
+		return value, nil
+	}
+	return uow.ChaincodeStubInterface.GetState(key)
+}
+
+// PutState - stage a write, an empty value deletes the key like on the ledger
+func (uow *UnitOfWork) PutState(key string, value []byte) error {
+	if _, found := uow.writes[key]; !found {
+		uow.keys = append(uow.keys, key)
+	}
+	uow.writes[key] = value
+	return nil
+}
+
+// DelState - stage a delete
+func (uow *UnitOfWork) DelState(key string) error {
+	if _, found := uow.writes[key]; !found {
+		uow.keys = append(uow.keys, key)
+	}
+	uow.writes[key] = nil
+	return nil
+}
+
+// GetStateByRange - the ledger keys of a range of simple keys, overlaid with the staged writes
+func (uow *UnitOfWork) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	iterator, err := uow.ChaincodeStubInterface.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return uow.merge(iterator, func(key string) bool {
+		return !is_composite_key(key) && key >= startKey && (len(endKey) == 0 || key < endKey)
+	})
+}
+
+// GetStateByPartialCompositeKey - the ledger keys under a partial composite key, overlaid with the staged writes
+func (uow *UnitOfWork) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := uow.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	iterator, err := uow.ChaincodeStubInterface.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return uow.merge(iterator, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// Merge - the ledger iterator itself when no staged key is in its range, otherwise its keys with the staged
+// writes of the range applied, in key order
+func (uow *UnitOfWork) merge(iterator shim.StateQueryIteratorInterface, in_range func(key string) bool) (shim.StateQueryIteratorInterface, error) {
+	var staged []string
+	for _, key := range uow.keys {
+		if in_range(key) {
+			staged = append(staged, key)
+		}
+	}
+	if len(staged) == 0 {
+		return iterator, nil
+	}
+	defer iterator.Close()
+
+	values := make(map[string][]byte)
+	for iterator.HasNext() {
+		aKeyValue, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		values[aKeyValue.Key] = aKeyValue.Value
+	}
+	for _, key := range staged {
+		if len(uow.writes[key]) == 0 {
+			delete(values, key)
+		} else {
+			values[key] = uow.writes[key]
+		}
+	}
+
+	merged := &StagedIterator{}
+	for key, value := range values {
+		merged.kvs = append(merged.kvs, &queryresult.KV{Key: key, Value: value})
+	}
+	sort.Slice(merged.kvs, func(i, j int) bool { return merged.kvs[i].Key < merged.kvs[j].Key })
+	return merged, nil
+}
+
+// GetPrivateData - the staged private value of a key if it was written in this unit
+func (uow *UnitOfWork) GetPrivateData(collection string, key string) ([]byte, error) {
+	if value, found := uow.private[collection][key]; found {
+		return value, nil
+	}
+	return uow.ChaincodeStubInterface.GetPrivateData(collection, key)
+}
+
+// PutPrivateData - stage a write to a private collection
+func (uow *UnitOfWork) PutPrivateData(collection string, key string, value []byte) error {
+	if uow.private[collection] == nil {
+		uow.private[collection] = make(map[string][]byte)
+	}
+	if _, found := uow.private[collection][key]; !found {
+		uow.order = append(uow.order, [2]string{collection, key})
+	}
+	uow.private[collection][key] = value
+	return nil
+}
+
+// Commit - emit every staged write to the stub, in the order the keys were first written
+func (uow *UnitOfWork) commit() error {
+	stub := uow.ChaincodeStubInterface
+	for _, key := range uow.keys {
+		var err error
+		if value := uow.writes[key]; len(value) == 0 {
+			err = stub.DelState(key)
+		} else {
+			err = stub.PutState(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range uow.order {
+		err := stub.PutPrivateData(entry[0], entry[1], uow.private[entry[0]][entry[1]])
+		if err != nil {
+			return err
+		}
+	}
+	uow.keys = nil
+	uow.writes = make(map[string][]byte)
+	uow.private = make(map[string]map[string][]byte)
+	uow.order = nil
+	return nil
+}
+
+// ----- StagedIterator ----- //
+// StagedIterator serves the key-values of a range read merged with the staged writes
+type StagedIterator struct {
+	kvs  []*queryresult.KV
+	next int
+}
+
+func (iterator *StagedIterator) HasNext() bool { return iterator.next < len(iterator.kvs) }
+
+func (iterator *StagedIterator) Next() (*queryresult.KV, error) {
+	if !iterator.HasNext() {
+		return nil, errors.New("no more keys")
+	}
+	iterator.next++
+	return iterator.kvs[iterator.next-1], nil
+}
+
+func (iterator *StagedIterator) Close() error { return nil }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Keys of - drain an iterator, returns its keys as key=value in order
+func keys_of(t *testing.T, iterator shim.StateQueryIteratorInterface, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iterator.Close()
+	var kvs []string
+	for iterator.HasNext() {
+		aKeyValue, err := iterator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kvs = append(kvs, aKeyValue.Key+"="+string(aKeyValue.Value))
+	}
+	return strings.Join(kvs, ",")
+}
+
+// Uow stub - a mock stub holding the simple keys a, c, e and the holders s1/u1 and s1/u2
+func uow_stub() *shim.MockStub {
+	stub := shim.NewMockStub("uow", nil)
+	stub.MockTransactionStart("seed")
+	for _, key := range []string{"a", "c", "e"} {
+		stub.PutState(key, []byte("old"))
+	}
+	for _, user := range []string{"u1", "u2"} {
+		key, _ := stub.CreateCompositeKey("h", []string{"s1", user})
+		stub.PutState(key, []byte("old"))
+	}
+	stub.MockTransactionEnd("seed")
+	stub.MockTransactionStart("uow")
+	return stub
+}
+
+func TestUnitOfWorkReadsItsOwnWrites(t *testing.T) {
+	stub := uow_stub()
+	uow := new_unit_of_work(stub)
+	uow.PutState("b", []byte("new"))
+	uow.PutState("c", []byte("new"))
+	uow.DelState("e")
+	uow.PutState("z", []byte("new"))
+
+	if value, _ := uow.GetState("c"); string(value) != "new" {
+		t.Fatalf("staged write not read - %s", value)
+	}
+	if value, _ := uow.GetState("e"); value != nil {
+		t.Fatalf("staged delete not read - %s", value)
+	}
+	iterator, err := uow.GetStateByRange("a", "z")
+	if kvs := keys_of(t, iterator, err); kvs != "a=old,b=new,c=new" {
+		t.Fatalf("range not merged - %s", kvs)
+	}
+
+	held, _ := uow.CreateCompositeKey("h", []string{"s1", "u3"})
+	uow.PutState(held, []byte("new"))
+	dropped, _ := uow.CreateCompositeKey("h", []string{"s1", "u1"})
+	uow.DelState(dropped)
+	iterator, err = uow.GetStateByPartialCompositeKey("h", []string{"s1"})
+	if kvs := keys_of(t, iterator, err); kvs != "\x00h\x00s1\x00u2\x00=old,\x00h\x00s1\x00u3\x00=new" {
+		t.Fatalf("partial composite key not merged - %q", kvs)
+	}
+}
+
+func TestUnitOfWorkWritesNothingBeforeCommit(t *testing.T) {
+	stub := uow_stub()
+	uow := new_unit_of_work(stub)
+	uow.PutState("b", []byte("new"))
+	uow.DelState("a")
+	if value, _ := stub.GetState("b"); value != nil {
+		t.Fatalf("write reached the stub before commit - %s", value)
+	}
+	if value, _ := stub.GetState("a"); value == nil {
+		t.Fatal("delete reached the stub before commit")
+	}
+
+	err := uow.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := stub.GetState("b"); string(value) != "new" {
+		t.Fatalf("write not committed - %s", value)
+	}
+	if value, _ := stub.GetState("a"); value != nil {
+		t.Fatalf("delete not committed - %s", value)
+	}
+}
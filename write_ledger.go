@@ -2,8 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"strconv"
+	"errors"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -12,124 +11,202 @@ import (
 // Init Stock - create a new stock, store into chaincode state
 func init_stock(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	var err error
-		fmt.Println("starting init_stock")
+		log_debug(stub, "starting")
 
-		if len(args) != 5 {
-			return shim.Error("Incorrect number of arguments. Expecting 5")
-		}
-
-		err = sanitize_arguments(args)
+		uow := new_unit_of_work(stub)
+		stock, user, err := build_stock(uow, args)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
-		id := args[0]
-		code := args[1]
-		count, err := strconv.Atoi(args[2])
-		if err != nil {
-			return shim.Error("2rd argument must be a numeric string")
-		}
-		price, err := strconv.Atoi(args[3])
-		if err != nil {
-			return shim.Error("3rd argument must be a numeric string")
-		}
-		user_id := args[4]
-		
-		// check user
-		user, err := get_user(stub, user_id)
+		stockAsBytes, _ := json.Marshal(stock)                         
+		err = put_entity(uow, stock_namespace, stock.Id, stockAsBytes)
 		if err != nil {
-			fmt.Println("Failed to find user -" + user_id)
 			return shim.Error(err.Error())
 		}
 
-		// check stock 
-		cstock, err := get_stock(stub, id)
-		if err == nil {
-			return shim.Error("This stock already exists - " + id)
-		}
-
-		if cstock.Code == code{
-			return shim.Error("This stock already exists - " + code)
+		err = put_stock_code(uow, stock)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
 
-		var stock Stock
-		stock.ObjectType = "stock"
-		stock.Id = id
-		stock.Code = code
-		stock.Count = count
-		stock.Price = price
-		stock.Creator.Id = user.Id
-		stock.Creator.Name = user.Name
-
-		stockAsBytes, _ := json.Marshal(stock)                         
-		err = stub.PutState(stock.Id, stockAsBytes)                    
+		err = update_wallet(uow, user.Id, stock, stock.Count, 0, "issue", stock.Id)
 		if err != nil {
-			fmt.Println("Could not store stock")
 			return shim.Error(err.Error())
 		}
 
-		var asset Asset
-		asset.Id = stock.Id
-		asset.Code = stock.Code
-		asset.Count = stock.Count
-		user.Wallet = append(user.Wallet, asset)
-
-		userAsBytes, _ := json.Marshal(user)                         
-		err = stub.PutState(user.Id, userAsBytes)                    
+		err = uow.commit()
 		if err != nil {
-			fmt.Println("Could not store user")
+			log_error(stub, "could not store stock", "err", err)
 			return shim.Error(err.Error())
 		}
 
-		fmt.Println("- end init_stock")
+		log_info(stub, "stock created", "stock_id", stock.Id, "code", stock.Code)
 		return shim.Success(nil)
 }
 
 // Init User - create a new user, store into chaincode state
 func init_user(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-		fmt.Println("starting init_user")
-	
-		if len(args) != 2 {
-			return shim.Error("Incorrect number of arguments. Expecting 2")
-		}
+		log_debug(stub, "starting")
 	
-		//input sanitation
-		err = sanitize_arguments(args)
+		uow := new_unit_of_work(stub)
+		user, err := build_user(uow, args)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 	
-		var user User
-		user.ObjectType = "user"
-		user.Id =  args[0]
-		user.Name = args[1]
-		user.Wallet = nil
-		fmt.Println(user)
-	
-		//check if user already exists
-		_, err = get_user(stub, user.Id)
-		if err == nil {
-			fmt.Println("This user already exists - " + user.Id)
-			return shim.Error("This user already exists - " + user.Id)
-		}
-	
 		//store user
 		userAsBytes, _ := json.Marshal(user)                         //convert to array of bytes
-		err = stub.PutState(user.Id, userAsBytes)                    //store owner by its Id
+		err = put_entity(uow, user_namespace, user.Id, userAsBytes)  //store owner by its Id
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = uow.commit()
 		if err != nil {
-			fmt.Println("Could not store user")
+			log_error(stub, "could not store user", "err", err)
 			return shim.Error(err.Error())
 		}
 	
-		fmt.Println("- end init_user")
+		log_info(stub, "user created", "user_id", user.Id)
 		return shim.Success(nil)
 }
 
-// Update price of stock
+// Build Stock - validate the arguments of init_stock, returns the new stock and its creator
+func build_stock(stub shim.ChaincodeStubInterface, args []string) (Stock, User, error) {
+	var stock Stock
+	var user User
+
+	if len(args) < 5 || len(args) > 8 {
+		return stock, user, errors.New("Incorrect number of arguments. Expecting 5 to 8")
+	}
+
+	err := sanitize_arguments(args)
+	if err != nil {
+		return stock, user, err
+	}
+
+	id := args[0]
+	code := args[1]
+	err = validate_id(id)
+	if err != nil {
+		return stock, user, err
+	}
+	price_scale := 0
+	if len(args) > 5 {
+		price_scale, err = parse_scale(args[5])
+		if err != nil {
+			return stock, user, errors.New("5th argument - " + err.Error())
+		}
+	}
+	unit_scale := 0
+	if len(args) > 6 {
+		unit_scale, err = parse_scale(args[6])
+		if err != nil {
+			return stock, user, errors.New("6th argument - " + err.Error())
+		}
+	}
+	count, err := parse_amount(args[2], unit_scale)
+	if err != nil {
+		return stock, user, errors.New("2rd argument must be a numeric string - " + err.Error())
+	}
+	price, err := parse_amount(args[3], price_scale)
+	if err != nil || price <= 0 {
+		return stock, user, errors.New("3rd argument must be a positive numeric string")
+	}
+	user_id := args[4]
+	var min_lot Amount
+	if len(args) > 7 {
+		min_lot, err = parse_amount(args[7], unit_scale)
+		if err != nil {
+			return stock, user, errors.New("7th argument must be a numeric string - " + err.Error())
+		}
+		if min_lot > count {
+			return stock, user, errors.New("7th argument must not exceed the count")
+		}
+	}
+
+	// check user
+	user, err = get_user(stub, user_id)
+	if err != nil {
+		return stock, user, err
+	}
+
+	// check stock
+	exists, err := entity_exists(stub, stock_namespace, id)
+	if err != nil {
+		return stock, user, errors.New("Failed to find stock - " + id)
+	}
+	if exists {
+		return stock, user, errors.New("This stock already exists - " + id)
+	}
+
+	// check code
+	code_id, err := get_stock_id_by_code(stub, code)
+	if err != nil {
+		return stock, user, err
+	}
+	if len(code_id) > 0 {
+		return stock, user, errors.New("This stock code is already used by " + code_id + " - " + code)
+	}
+
+	stock.ObjectType = "stock"
+	stock.Version = stock_version()
+	stock.Id = id
+	stock.Code = code
+	stock.Count = count
+	stock.Price = price
+	stock.RefPrice = price
+	stock.BandBps = default_band_bps
+	stock.HaltBps = default_halt_bps
+	stock.PriceScale = price_scale
+	stock.UnitScale = unit_scale
+	stock.MinLot = min_lot
+	stock.Status = stock_active
+	stock.Creator.Id = user.Id
+	stock.Creator.Name = user.Name
+	return stock, user, nil
+}
+
+// Build User - validate the arguments of init_user, returns the new user
+func build_user(stub shim.ChaincodeStubInterface, args []string) (User, error) {
+	var user User
+
+	if len(args) != 2 {
+		return user, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	//input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return user, err
+	}
+	err = validate_id(args[0])
+	if err != nil {
+		return user, err
+	}
+
+	user.ObjectType = "user"
+	user.Version = user_version()
+	user.Id = args[0]
+	user.Name = args[1]
+	user.Wallet = nil
+
+	//check if user already exists
+	exists, err := entity_exists(stub, user_namespace, user.Id)
+	if err != nil {
+		return user, errors.New("Failed to get user - " + user.Id)
+	}
+	if exists {
+		return user, errors.New("This user already exists - " + user.Id)
+	}
+	return user, nil
+}
+
+// Update price of stock, by its creator or an admin
 func update_price(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting update_price")
+	log_debug(stub, "starting")
 
 	if len(args) != 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 2")
@@ -141,37 +218,60 @@ func update_price(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	uow := new_unit_of_work(stub)
 	var id = args[0]
-	new_price, err := strconv.Atoi(args[1])
+	res, err := get_stock(uow, id)
 	if err != nil {
-		return shim.Error("2rd argument must be a numeric string")
+		return shim.Error("Failed to get stock - " + err.Error())
+	}
+	err = check_owner(stub, res.Creator.Id)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	stockAsBytes, err := stub.GetState(id)
+	err = check_active(res)
 	if err != nil {
-		return shim.Error("Failed to get stock")
+		return shim.Error(err.Error())
+	}
+
+	new_price, err := parse_amount(args[1], res.PriceScale)
+	if err != nil {
+		return shim.Error("2rd argument must be a numeric string - " + err.Error())
+	}
+	halt, err := check_price(uow, &res, new_price)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	res := Stock{}
-	json.Unmarshal(stockAsBytes, &res)           
 
 	res.Price = new_price
+	if res.RefPrice == 0 {
+		res.RefPrice = new_price
+	}
+	if halt {
+		res.Status = stock_halted
+		log_warning(stub, "circuit breaker hit, stock halted", "stock_id", res.Id, "price", format_amount(new_price, res.PriceScale),
+			"ref_price", format_amount(res.RefPrice, res.PriceScale))
+	}
 	jsonAsBytes, _ := json.Marshal(res)           //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes)     //rewrite the stock with id as key
+	err = put_entity(uow, stock_namespace, res.Id, jsonAsBytes) //rewrite the stock with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = uow.commit()
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	fmt.Println(res.Code + "->" + strconv.Itoa(new_price))
-	fmt.Println("- end update price")
+	log_info(stub, "price updated", "stock_id", res.Id, "price", format_amount(new_price, res.PriceScale))
 	return shim.Success(nil)
 }
 
 func init_transaction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting init_transaction")
+	log_debug(stub, "starting")
 
-	if len(args) != 6 {
-		return shim.Error("Incorrect number of arguments. Expecting 6")
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 6 to 7")
 	}
 
 	// input sanitation
@@ -182,68 +282,112 @@ func init_transaction(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 
 	trade_id := args[0]
 	stock_id := args[1]
-	stock_count, err := strconv.Atoi(args[2])
-	if err != nil {
-		return shim.Error("2rd argument must be a numeric string")
-	}
 	seller_id := args[3]
 	buyer_id := args[4]
 	time := args[5]
+	err = validate_id(trade_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	uow := new_unit_of_work(stub)
 
-	// check stock 
-	ctransaction, err := get_transaction(stub, trade_id)
-	if err == nil {
+	// check transaction
+	exists, err := entity_exists(uow, trade_namespace, trade_id)
+	if err != nil {
+		return shim.Error("Failed to get transaction - " + trade_id)
+	}
+	if exists {
 		return shim.Error("This transaction already exists - " + trade_id)
 	}
-	_ = ctransaction
 
 	// check if seller already exists
-	seller, err := get_user(stub, seller_id)
+	seller, err := get_user(uow, seller_id)
 	if err != nil {
 		return shim.Error("This seller does not exist - " + seller_id)
 	}
 
 	// check if buyer already exists
-	buyer, err := get_user(stub, buyer_id)
+	buyer, err := get_user(uow, buyer_id)
 	if err != nil {
 		return shim.Error("This buyer does not exist - " + buyer_id)
 	}
 
-	stock, err := get_stock(stub, stock_id)
+	stock, err := get_stock(uow, stock_id)
 	if err != nil {
 		return shim.Error("This stock does not exist - " + stock_id)
 	}
+	err = check_active(stock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	fmt.Println(buyer.Id + " - " + buyer.Name + " buy " + args[2] + " code " + stock.Code + " from " + seller.Id + " - " + seller.Name)
+	stock_count, err := parse_amount(args[2], stock.UnitScale)
+	if err != nil || stock_count <= 0 {
+		return shim.Error("2rd argument must be a positive numeric string")
+	}
+	if stock_count < stock.MinLot {
+		return shim.Error("The count is below the minimum lot of " + format_amount(stock.MinLot, stock.UnitScale))
+	}
 
-	// get seller
-	sellerAsBytes, err := stub.GetState(seller_id)
+	var price Amount
+	if len(args) == 7 {
+		price, err = parse_amount(args[6], stock.PriceScale)
+		if err != nil || price <= 0 {
+			return shim.Error("6th argument must be a positive numeric string")
+		}
+	}
+
+	// confidential terms
+	terms, err := get_trade_terms(uow, stock.PriceScale)
 	if err != nil {
-		return shim.Error("Failed to get seller info")
+		return shim.Error(err.Error())
+	}
+	if terms != nil && price > 0 {
+		return shim.Error("Price must be passed either as argument or in transient '" + trade_terms_transient + "'")
 	}
-	res := User{}
-	json.Unmarshal(sellerAsBytes, &res)           //un stringify it aka JSON.parse()
 
-	// check wallet seller
-	if len(res.Wallet) > 0 {
-		for i := len(res.Wallet) - 1; i >= 0; i-- {
-			if res.Wallet[i].Id == stock.Id {
-				if res.Wallet[i].Count >= stock_count {
-					break
-				} else {
-					return shim.Error("The amount in the wallet is not enough")
-				}
-			}
+	// price band
+	trade_price := price
+	if terms != nil {
+		trade_price = terms.Price
+	}
+	ref_day := stock.RefDay
+	var halt bool
+	if trade_price > 0 {
+		halt, err = check_price(uow, &stock, trade_price)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
-	} else {
+	}
+
+	log_debug(stub, "trade", "buyer", buyer.Id, "buyer_name", buyer.Name, "seller", seller.Id, "seller_name", seller.Name,
+		"stock_id", stock.Id, "count", args[2])
+
+	// check wallet seller
+	holding, err := get_holding(uow, seller, stock.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	held := holding.Count
+	if held < stock_count {
 		return shim.Error("The amount in the wallet is not enough")
 	}
+	if below_lot(stock, held-stock_count) {
+		return shim.Error("The trade would leave less than the minimum lot in the wallet, sell the whole position")
+	}
 
-	update_wallet(stub, seller, stock.Id, stock.Code, stock_count, 1)
-	update_wallet(stub, buyer, stock.Id, stock.Code, stock_count, 0)
+	err = update_wallet(uow, seller.Id, stock, stock_count, 1, "sell", trade_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = update_wallet(uow, buyer.Id, stock, stock_count, 0, "buy", trade_id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	var transaction Trade
 	transaction.ObjectType = "trade"
+	transaction.Version = trade_version()
 	transaction.Id = trade_id
 	transaction.Stock.Id = stock_id
 	transaction.Stock.Code = stock.Code
@@ -253,59 +397,97 @@ func init_transaction(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 	transaction.Buyer.Id = buyer.Id
 	transaction.Buyer.Name = buyer.Name
 	transaction.Time = time
+	transaction.Price = price
+
+	if terms != nil {
+		terms.Id = transaction.Id
+		terms.SellerName = seller.Name
+		terms.BuyerName = buyer.Name
+		transaction.TermsHash, err = put_trade_terms(uow, *terms)
+		if err != nil {
+			log_error(stub, "could not store private terms", "err", err)
+			return shim.Error(err.Error())
+		}
+		transaction.Seller.Name = ""
+		transaction.Buyer.Name = ""
+	}
 
 	tradeAsBytes, _ := json.Marshal(transaction)                         
-	err = stub.PutState(transaction.Id, tradeAsBytes)                    
+	err = put_entity(uow, trade_namespace, transaction.Id, tradeAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = index_trade(uow, transaction)
 	if err != nil {
-		fmt.Println("Could not store transaction")
+		log_error(stub, "could not index transaction", "err", err)
 		return shim.Error(err.Error())
 	}
 
-	fmt.Println("- end init_transaction")
+	if halt {
+		stock.Status = stock_halted
+		log_warning(stub, "circuit breaker hit, stock halted", "stock_id", stock.Id, "trade_id", transaction.Id,
+			"ref_price", format_amount(stock.RefPrice, stock.PriceScale))
+	}
+	if halt || stock.RefDay != ref_day {
+		stockAsBytes, _ := json.Marshal(stock) //convert to array of bytes
+		err = put_entity(uow, stock_namespace, stock.Id, stockAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = update_candle(uow, transaction)
+	if err != nil {
+		log_error(stub, "could not update candle", "err", err)
+		return shim.Error(err.Error())
+	}
+
+	err = uow.commit()
+	if err != nil {
+		log_error(stub, "could not store transaction", "err", err)
+		return shim.Error(err.Error())
+	}
+
+	log_info(stub, "transaction recorded", "trade_id", transaction.Id, "stock_id", stock.Id)
 	return shim.Success(nil)
 }
 
-func update_wallet(stub shim.ChaincodeStubInterface, user User, stock_id string, stock_code string, count int, operation int) pb.Response {
-	var err error
-	fmt.Println("starting update_walllet")
-
+// Update wallet - add (operation 0) or remove (operation 1) a count of a stock in the holdings of a user,
+// recorded as a delta with its cause and reference. Only removals read the balance, so only they can
+// conflict with another change of the same position in the block (see delta_by_user).
+// A wallet still embedded in the user document is moved to holding keys first
+func update_wallet(stub shim.ChaincodeStubInterface, user_id string, stock Stock, count Amount, operation int, cause string, ref string) error {
+	user, err := get_user(stub, user_id)
+	if err != nil {
+		return err
+	}
 	if len(user.Wallet) > 0 {
-		var check = 0
-		for i := len(user.Wallet) - 1; i >= 0; i-- {
-			if user.Wallet[i].Code == stock_code {
-				check = 1
-				if operation == 0 {
-					user.Wallet[i].Count += count
-				} else {
-					user.Wallet[i].Count -= count
-					if user.Wallet[i].Count <= 0 {
-						user.Wallet = append(user.Wallet[:i], user.Wallet[i+1:]...)
-					}
-				}
-			}
+		err = move_wallet(stub, &user)
+		if err != nil {
+			return err
 		}
-		if (check == 0) {
-			var asset Asset
-			asset.Id = stock_id
-			asset.Code = stock_code
-			asset.Count = count
-			user.Wallet = append(user.Wallet, asset)
+	}
+
+	delta := Delta{UserId: user.Id, StockId: stock.Id, Count: count, Cause: cause, Ref: ref}
+	var balance Amount
+	if operation != 0 {
+		asset, err := get_holding(stub, user, stock.Id)
+		if err != nil {
+			return err
 		}
-	} else {
-		var asset Asset
-		asset.Id = stock_id
-		asset.Code = stock_code
-		asset.Count = count
-		user.Wallet = append(user.Wallet, asset)
+		if asset.Count < count {
+			return errors.New("The amount in the wallet is not enough")
+		}
+		balance = asset.Count
+		delta.Count = -count
 	}
 
-	jsonAsBytes, _ := json.Marshal(user)          
-	err = stub.PutState(user.Id, jsonAsBytes)     
+	err = put_delta(stub, delta, balance)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
-	fmt.Println(user)
-	fmt.Println("- end update price")
-	return shim.Success(nil)
-}
\ No newline at end of file
+	log_debug(stub, "balance change", "user_id", user.Id, "stock_id", stock.Id, "cause", cause, "count", format_amount(delta.Count, stock.UnitScale))
+	return nil
+}